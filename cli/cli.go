@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+// Package cli signs in the user of a command line tool with a provider, following the
+// loopback redirect of OAuth 2.0 for Native Apps (RFC 8252).
+//
+// Login listens on an ephemeral 127.0.0.1 port, opens the system browser at the auth URL
+// (with state and PKCE) and waits for the callback, whose code is exchanged for the token and user.
+// The loopback redirect URI overrides the provider RedirectURL with the `redirect_uri` param, so it
+// works with the providers built on oauth2.Config (GitHub, Google, Microsoft, OIDC, ...) once the
+// loopback URI is allowed by the app registration (e.g. a Google "Desktop app" client).
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+const (
+	defaultCallbackPath    = "/callback"
+	defaultTimeout         = 5 * time.Minute
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// Options customizes Login, the zero value is ready to use
+type Options struct {
+	// Port is the loopback port, a random free port by default.
+	// Set it for apps whose registration requires the exact redirect URI.
+	Port int
+	// CallbackPath is the path of the loopback redirect URI, "/callback" by default
+	CallbackPath string
+	// NoBrowser only prints the auth URL, e.g. when the browser runs on another machine
+	NoBrowser bool
+	// OpenBrowser opens the auth URL, the system browser by default
+	OpenBrowser func(authURL string) error
+	// Output receives the auth URL to open manually, os.Stderr by default
+	Output io.Writer
+	// Timeout bounds the wait for the user, 5 minutes by default
+	Timeout time.Duration
+	// ShutdownTimeout bounds the shutdown of the listener, once the page is served, 5 seconds by default
+	ShutdownTimeout time.Duration
+}
+
+// result is the outcome of the callback
+type result struct {
+	token    *oauth2.Token
+	userInfo *types.UserInfo
+	err      error
+}
+
+// Login signs in with provider in the browser and returns the token and user, as a browser login would
+func Login(ctx context.Context, provider types.Provider, opts Options) (*oauth2.Token, *types.UserInfo, error) {
+	if opts.CallbackPath == "" {
+		opts.CallbackPath = defaultCallbackPath
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stderr
+	}
+	if opts.OpenBrowser == nil {
+		opts.OpenBrowser = openBrowser
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	// RFC 8252 7.3: the loopback IP literal, not localhost, which may resolve to another interface
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", opts.Port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cli: failed to listen on the loopback: %w", err)
+	}
+	redirectURI := fmt.Sprintf("http://%s%s", listener.Addr().String(), opts.CallbackPath)
+
+	state, err := randomState()
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+	redirectOption := oauth2.SetAuthURLParam("redirect_uri", redirectURI)
+
+	authURL := provider.GetAuthURL(ctx, state, oauth2.S256ChallengeOption(verifier), redirectOption)
+	if authURL == "" {
+		listener.Close()
+		return nil, nil, fmt.Errorf("cli: the provider returned no auth URL")
+	}
+
+	results := make(chan result, 1)
+	var (
+		once sync.Once
+		res  result
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc(opts.CallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		// Other requests (e.g. a stale tab) must not end the login, only the callback of this state does
+		if query.Get("state") != state {
+			renderPage(w, http.StatusBadRequest, fmt.Errorf("invalid state, start the login again"))
+			return
+		}
+
+		// The code is exchanged once, a later callback (e.g. a refresh of the page) renders the same outcome
+		first := false
+		once.Do(func() {
+			first = true
+			if errCode := query.Get("error"); errCode != "" {
+				res.err = fmt.Errorf("cli: authorization failed: %s %s", errCode, query.Get("error_description"))
+			} else {
+				res.token, res.err = provider.ExchangeCodeForToken(r.Context(), query.Get("code"), oauth2.VerifierOption(verifier), redirectOption)
+				if res.err == nil {
+					res.userInfo, res.err = provider.GetUserInfo(r.Context(), res.token)
+				}
+			}
+		})
+
+		status := http.StatusOK
+		if res.err != nil {
+			status = http.StatusUnauthorized
+		}
+		renderPage(w, status, res.err)
+
+		if first {
+			results <- res
+		}
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	defer func() {
+		// The shutdown waits for the page to be written before closing the connections
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if opts.NoBrowser || opts.OpenBrowser(authURL) != nil {
+		fmt.Fprintf(opts.Output, "Open the following URL in your browser to sign in:\n\n%s\n\n", authURL)
+	} else {
+		fmt.Fprintf(opts.Output, "Your browser has been opened to sign in. If it did not open, visit:\n\n%s\n\n", authURL)
+	}
+
+	select {
+	case res := <-results:
+		return res.token, res.userInfo, res.err
+	case err := <-serveErr:
+		return nil, nil, fmt.Errorf("cli: loopback server failed: %w", err)
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, nil, fmt.Errorf("cli: no sign in within %s", opts.Timeout)
+		}
+		return nil, nil, ctx.Err()
+	}
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openBrowser opens url in the system browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{if .Err}}Sign in failed{{else}}Signed in{{end}}</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 15%;">
+	{{if .Err}}
+	<h1>Sign in failed</h1>
+	<p>{{.Err}}</p>
+	{{else}}
+	<h1>You are signed in</h1>
+	<p>You can close this window and return to the terminal.</p>
+	{{end}}
+</body>
+</html>
+`))
+
+func renderPage(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	pageTemplate.Execute(w, struct{ Err error }{err})
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// fakeProvider is a provider built on oauth2.Config, whose token endpoint records the token requests
+type fakeProvider struct {
+	config *oauth2.Config
+
+	mu            sync.Mutex
+	tokenRequests []url.Values
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	p := &fakeProvider{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		p.tokenRequests = append(p.tokenRequests, r.PostForm)
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "token-of-" + r.PostForm.Get("code"), "token_type": "Bearer"})
+	}))
+	t.Cleanup(server.Close)
+	p.config = &oauth2.Config{
+		ClientID:    "client-id",
+		RedirectURL: "https://app.example.org/callback",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   "https://provider.example.org/authorize",
+			TokenURL:  server.URL + "/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+	return p
+}
+
+func (p *fakeProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *fakeProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *fakeProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	return &types.UserInfo{Provider: "fake", ProviderUserID: token.AccessToken}, nil
+}
+
+func (p *fakeProvider) exchanges() []url.Values {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]url.Values(nil), p.tokenRequests...)
+}
+
+// authParam returns the query parameter name of authURL
+func authParam(t *testing.T, authURL, name string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get(name)
+}
+
+// callback requests the loopback redirect URI of authURL with query, as the browser redirected by the provider would
+func callback(t *testing.T, authURL string, query url.Values) (int, string) {
+	t.Helper()
+	resp, err := http.Get(authParam(t, authURL, "redirect_uri") + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestLogin(t *testing.T) {
+	provider := newFakeProvider(t)
+	var authURL string
+	token, userInfo, err := Login(context.Background(), provider, Options{
+		Output: io.Discard,
+		OpenBrowser: func(u string) error {
+			authURL = u
+			// A callback of another login is rejected without ending this one
+			if status, _ := callback(t, u, url.Values{"code": {"other"}, "state": {"other-state"}}); status != http.StatusBadRequest {
+				t.Errorf("wrong state: status %d, want 400", status)
+			}
+			if status, body := callback(t, u, url.Values{"code": {"code-1"}, "state": {authParam(t, u, "state")}}); status != http.StatusOK || !strings.Contains(body, "You are signed in") {
+				t.Errorf("callback: status %d, body %s", status, body)
+			}
+			// A refresh of the page renders it again, without exchanging the code twice
+			if status, _ := callback(t, u, url.Values{"code": {"code-1"}, "state": {authParam(t, u, "state")}}); status != http.StatusOK {
+				t.Errorf("refresh: status %d, want 200", status)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token-of-code-1" || userInfo.ProviderUserID != "token-of-code-1" {
+		t.Fatalf("got %+v, %+v", token, userInfo)
+	}
+
+	exchanges := provider.exchanges()
+	if len(exchanges) != 1 {
+		t.Fatalf("%d code exchanges, want 1", len(exchanges))
+	}
+	// The PKCE verifier of the challenge and the loopback redirect URI of the auth URL reach the token endpoint
+	challenge := authParam(t, authURL, "code_challenge")
+	if oauth2.S256ChallengeFromVerifier(exchanges[0].Get("code_verifier")) != challenge || authParam(t, authURL, "code_challenge_method") != "S256" {
+		t.Fatalf("code_verifier %q does not match the code_challenge %q", exchanges[0].Get("code_verifier"), challenge)
+	}
+	redirectURI := authParam(t, authURL, "redirect_uri")
+	if !strings.HasPrefix(redirectURI, "http://127.0.0.1:") || !strings.HasSuffix(redirectURI, "/callback") || exchanges[0].Get("redirect_uri") != redirectURI {
+		t.Fatalf("redirect_uri %q, exchanged with %q", redirectURI, exchanges[0].Get("redirect_uri"))
+	}
+
+	// The listener is closed once signed in
+	if resp, err := http.Get(redirectURI); err == nil {
+		resp.Body.Close()
+		t.Fatal("the loopback listener is still open")
+	}
+}
+
+func TestLoginAuthorizationError(t *testing.T) {
+	provider := newFakeProvider(t)
+	_, _, err := Login(context.Background(), provider, Options{
+		Output: io.Discard,
+		OpenBrowser: func(u string) error {
+			query := url.Values{"error": {"access_denied"}, "error_description": {"the user denied the request"}, "state": {authParam(t, u, "state")}}
+			if status, body := callback(t, u, query); status != http.StatusUnauthorized || !strings.Contains(body, "access_denied") {
+				t.Errorf("callback: status %d, body %s", status, body)
+			}
+			return nil
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Fatalf("err = %v, want access_denied", err)
+	}
+	if exchanges := provider.exchanges(); len(exchanges) != 0 {
+		t.Fatalf("%d code exchanges, want none", len(exchanges))
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	var output strings.Builder
+	_, _, err := Login(context.Background(), newFakeProvider(t), Options{
+		NoBrowser: true,
+		Output:    &output,
+		Timeout:   100 * time.Millisecond,
+		OpenBrowser: func(u string) error {
+			t.Error("the browser was opened with NoBrowser")
+			return nil
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "no sign in within 100ms") {
+		t.Fatalf("err = %v, want no sign in", err)
+	}
+
+	// The auth URL is printed instead, and the listener is closed
+	var authURL string
+	for _, line := range strings.Split(output.String(), "\n") {
+		if strings.HasPrefix(line, "https://provider.example.org/authorize?") {
+			authURL = line
+		}
+	}
+	if authURL == "" {
+		t.Fatalf("auth URL not printed: %q", output.String())
+	}
+	if resp, err := http.Get(authParam(t, authURL, "redirect_uri")); err == nil {
+		resp.Body.Close()
+		t.Fatal("the loopback listener is still open")
+	}
+}
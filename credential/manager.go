@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+// Package credential caches app-level credentials of OAuth providers.
+//
+// Vendors such as Feishu, DingTalk and WeCom issue app-wide access tokens which are
+// valid for about two hours and have strict issuance rate limits. The Manager caches
+// them in a Store, refreshes them once (single-flight) shortly before they expire,
+// and drops them when the vendor reports them invalid.
+package credential
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrExpired is wrapped by provider errors whose vendor error code means the credential is invalid or expired
+var ErrExpired = errors.New("credential is invalid or expired")
+
+// FetchFunc issues a new credential from the vendor
+type FetchFunc func(ctx context.Context) (*Token, error)
+
+// Default is the Manager used by providers when none is configured
+var Default = NewManager()
+
+// Manager caches credentials in a Store and refreshes them on demand
+type Manager struct {
+	store         Store
+	refreshBefore time.Duration
+	lockTTL       time.Duration
+	fetchTimeout  time.Duration
+	waitInterval  time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is an in-flight refresh shared by concurrent callers
+type call struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// WithStore sets the Store credentials are kept in, a MemoryStore is used by default
+func WithStore(store Store) Option {
+	return func(m *Manager) {
+		m.store = store
+	}
+}
+
+// WithRefreshBefore sets how long before the expiry a credential is renewed, 5 minutes by default
+func WithRefreshBefore(d time.Duration) Option {
+	return func(m *Manager) {
+		m.refreshBefore = d
+	}
+}
+
+// WithLockTTL sets how long a replica may hold the refresh lock of a Locker store, 10 seconds by default
+func WithLockTTL(d time.Duration) Option {
+	return func(m *Manager) {
+		m.lockTTL = d
+	}
+}
+
+// WithFetchTimeout bounds a shared refresh, which does not stop when the caller that started it gives up, 30 seconds by default
+func WithFetchTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.fetchTimeout = d
+	}
+}
+
+// NewManager creates a new credential Manager
+func NewManager(opts ...Option) *Manager {
+	m := &Manager{
+		store:         NewMemoryStore(),
+		refreshBefore: 5 * time.Minute,
+		lockTTL:       10 * time.Second,
+		fetchTimeout:  30 * time.Second,
+		waitInterval:  200 * time.Millisecond,
+		calls:         make(map[string]*call),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Get returns the credential cached for key, calling fetch to issue a new one when
+// it is missing or about to expire. Concurrent callers share a single fetch.
+func (m *Manager) Get(ctx context.Context, key string, fetch FetchFunc) (string, error) {
+	token, err := m.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if m.fresh(token) {
+		return token.Value, nil
+	}
+
+	refreshed, err := m.refresh(ctx, key, fetch)
+	if err != nil {
+		// Keep using the cached credential while it is still valid
+		if token != nil && time.Now().Before(token.ExpiresAt) {
+			return token.Value, nil
+		}
+		return "", err
+	}
+	return refreshed.Value, nil
+}
+
+// Invalidate drops the credential cached for key, the next Get issues a new one
+func (m *Manager) Invalidate(ctx context.Context, key string) error {
+	return m.store.Delete(ctx, key)
+}
+
+// Do calls fn with the credential cached for key. If fn fails with an error wrapping
+// ErrExpired, the credential is invalidated and fn is retried once with a new one
+// (or with the one another caller stored meanwhile).
+func (m *Manager) Do(ctx context.Context, key string, fetch FetchFunc, fn func(credential string) error) error {
+	value, err := m.Get(ctx, key, fetch)
+	if err != nil {
+		return err
+	}
+
+	err = fn(value)
+	if !errors.Is(err, ErrExpired) {
+		return err
+	}
+
+	if err := m.invalidate(ctx, key, value); err != nil {
+		return err
+	}
+	value, err = m.Get(ctx, key, fetch)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// invalidate drops the credential cached for key if it is still the rejected one,
+// so that a caller with a stale credential does not drop the new one stored by another caller
+func (m *Manager) invalidate(ctx context.Context, key, rejected string) error {
+	token, err := m.store.Get(ctx, key)
+	if err != nil || token == nil || token.Value != rejected {
+		return err
+	}
+	return m.store.Delete(ctx, key)
+}
+
+// fresh reports whether token does not need to be renewed yet
+func (m *Manager) fresh(token *Token) bool {
+	return token != nil && token.Value != "" && time.Now().Add(m.refreshBefore).Before(token.ExpiresAt)
+}
+
+// refresh issues a new credential for key, sharing the work between concurrent callers
+func (m *Manager) refresh(ctx context.Context, key string, fetch FetchFunc) (*Token, error) {
+	m.mu.Lock()
+	c, ok := m.calls[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		m.calls[key] = c
+		go m.run(ctx, key, fetch, c)
+	}
+	m.mu.Unlock()
+
+	// Each caller only gives up on its own ctx, the shared refresh goes on for the others
+	select {
+	case <-c.done:
+		return c.token, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run performs the shared refresh c, detached from the cancellation of the caller that started it
+func (m *Manager) run(ctx context.Context, key string, fetch FetchFunc, c *call) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.fetchTimeout)
+	defer cancel()
+
+	c.token, c.err = m.fetch(ctx, key, fetch)
+
+	m.mu.Lock()
+	delete(m.calls, key)
+	m.mu.Unlock()
+	close(c.done)
+}
+
+// fetch issues a new credential and stores it, coordinating with other replicas when the store is a Locker
+func (m *Manager) fetch(ctx context.Context, key string, fetch FetchFunc) (*Token, error) {
+	locker, ok := m.store.(Locker)
+	if !ok {
+		return m.fetchAndStore(ctx, key, fetch)
+	}
+
+	deadline := time.Now().Add(m.lockTTL)
+	for {
+		locked, err := locker.TryLock(ctx, key, m.lockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			defer locker.Unlock(context.WithoutCancel(ctx), key)
+			// Another replica may have refreshed it while we were waiting for the lock
+			if token, err := m.store.Get(ctx, key); err == nil && m.fresh(token) {
+				return token, nil
+			}
+			return m.fetchAndStore(ctx, key, fetch)
+		}
+
+		// Another replica is refreshing, wait for its credential
+		select {
+		case <-time.After(m.waitInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if token, err := m.store.Get(ctx, key); err == nil && m.fresh(token) {
+			return token, nil
+		}
+		if time.Now().After(deadline) {
+			// The lock holder is gone without storing a credential
+			return m.fetchAndStore(ctx, key, fetch)
+		}
+	}
+}
+
+func (m *Manager) fetchAndStore(ctx context.Context, key string, fetch FetchFunc) (*Token, error) {
+	token, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Set(ctx, key, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package credential
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFetch issues "token-<n>" credentials valid for ttl, counting the calls
+func countingFetch(calls *atomic.Int32, ttl time.Duration) FetchFunc {
+	return func(ctx context.Context) (*Token, error) {
+		n := calls.Add(1)
+		return &Token{Value: fmt.Sprintf("token-%d", n), ExpiresAt: time.Now().Add(ttl)}, nil
+	}
+}
+
+func TestManagerGetConcurrentSingleFetch(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*Token, error) {
+		calls.Add(1)
+		// Hold the refresh until every caller is waiting on it
+		<-release
+		return &Token{Value: "shared", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	values := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], errs[i] = m.Get(ctx, "app", fetch)
+		}(i)
+	}
+
+	// Wait for the refresh to start, then give the other callers time to join it
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("fetch called %d times, want 1", got)
+	}
+	for i := 0; i < n; i++ {
+		if errs[i] != nil || values[i] != "shared" {
+			t.Fatalf("caller %d got %q, %v", i, values[i], errs[i])
+		}
+	}
+
+	// The credential is now cached
+	if value, err := m.Get(ctx, "app", fetch); err != nil || value != "shared" || calls.Load() != 1 {
+		t.Fatalf("cached Get got %q, %v after %d fetches", value, err, calls.Load())
+	}
+}
+
+func TestManagerGetLeaderCanceled(t *testing.T) {
+	m := NewManager()
+
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	fetch := func(ctx context.Context) (*Token, error) {
+		calls.Add(1)
+		close(started)
+		<-release
+		// The shared refresh is not canceled with the caller that started it
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &Token{Value: "shared", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := m.Get(leaderCtx, "app", fetch)
+		leaderErr <- err
+	}()
+	<-started
+
+	waiterValue := make(chan string, 1)
+	go func() {
+		value, err := m.Get(context.Background(), "app", fetch)
+		if err != nil {
+			t.Errorf("waiter got %v", err)
+		}
+		waiterValue <- value
+	}()
+
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader got %v, want context.Canceled", err)
+	}
+	close(release)
+	if value := <-waiterValue; value != "shared" {
+		t.Fatalf("waiter got %q, want shared", value)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("fetch called %d times, want 1", got)
+	}
+}
+
+func TestManagerGetExpiredStore(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(WithStore(store), WithRefreshBefore(time.Minute))
+	ctx := context.Background()
+
+	store.Set(ctx, "app", &Token{Value: "expired", ExpiresAt: time.Now().Add(-time.Second)})
+
+	var calls atomic.Int32
+	value, err := m.Get(ctx, "app", countingFetch(&calls, time.Hour))
+	if err != nil || value != "token-1" {
+		t.Fatalf("Get got %q, %v, want token-1", value, err)
+	}
+	if stored, _ := store.Get(ctx, "app"); stored == nil || stored.Value != "token-1" {
+		t.Fatalf("store holds %+v, want token-1", stored)
+	}
+}
+
+func TestManagerGetRefreshFailure(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(WithStore(store), WithRefreshBefore(time.Minute))
+	ctx := context.Background()
+	failing := func(ctx context.Context) (*Token, error) {
+		return nil, errors.New("rate limited")
+	}
+
+	// About to expire but still valid: the cached credential is kept
+	store.Set(ctx, "app", &Token{Value: "cached", ExpiresAt: time.Now().Add(30 * time.Second)})
+	if value, err := m.Get(ctx, "app", failing); err != nil || value != "cached" {
+		t.Fatalf("Get got %q, %v, want cached", value, err)
+	}
+
+	// Expired: the refresh error is returned
+	store.Set(ctx, "app", &Token{Value: "cached", ExpiresAt: time.Now().Add(-time.Second)})
+	if _, err := m.Get(ctx, "app", failing); err == nil {
+		t.Fatal("Get of an expired credential succeeded despite the refresh error")
+	}
+}
+
+func TestManagerDoRetriesOnErrExpired(t *testing.T) {
+	m := NewManager()
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	fetch := countingFetch(&calls, time.Hour)
+	var used []string
+	err := m.Do(ctx, "app", fetch, func(credential string) error {
+		used = append(used, credential)
+		if credential == "token-1" {
+			// Vendor errors wrap ErrExpired
+			return fmt.Errorf("vendor error 40014: %w", ErrExpired)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if len(used) != 2 || used[0] != "token-1" || used[1] != "token-2" {
+		t.Fatalf("Do used %v, want [token-1 token-2]", used)
+	}
+
+	// Other errors are returned without a retry
+	other := errors.New("boom")
+	err = m.Do(ctx, "app", fetch, func(credential string) error { return other })
+	if !errors.Is(err, other) || calls.Load() != 2 {
+		t.Fatalf("Do got %v after %d fetches, want boom after 2", err, calls.Load())
+	}
+}
+
+func TestManagerDoKeepsNewerCredential(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(WithStore(store))
+	ctx := context.Background()
+
+	store.Set(ctx, "app", &Token{Value: "stale", ExpiresAt: time.Now().Add(time.Hour)})
+
+	var calls atomic.Int32
+	var used []string
+	err := m.Do(ctx, "app", countingFetch(&calls, time.Hour), func(credential string) error {
+		used = append(used, credential)
+		if credential == "stale" {
+			// Another caller got the rejection first and already stored a new credential
+			store.Set(ctx, "app", &Token{Value: "renewed", ExpiresAt: time.Now().Add(time.Hour)})
+			return ErrExpired
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if len(used) != 2 || used[1] != "renewed" || calls.Load() != 0 {
+		t.Fatalf("Do used %v after %d fetches, want the renewed credential without a fetch", used, calls.Load())
+	}
+}
+
+// lockingStore is a MemoryStore implementing Locker, as a shared store of several replicas would
+type lockingStore struct {
+	*MemoryStore
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (s *lockingStore) TryLock(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[key] {
+		return false, nil
+	}
+	s.locked[key] = true
+	return true, nil
+}
+
+func (s *lockingStore) Unlock(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locked, key)
+	return nil
+}
+
+func TestManagerLockerSharedAcrossReplicas(t *testing.T) {
+	store := &lockingStore{MemoryStore: NewMemoryStore(), locked: make(map[string]bool)}
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	fetch := func(ctx context.Context) (*Token, error) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return &Token{Value: "shared", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+
+	// Each Manager is a replica, they only share the store
+	const replicas = 5
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		m := NewManager(WithStore(store))
+		m.waitInterval = 5 * time.Millisecond
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := m.Get(ctx, "app", fetch); err != nil || value != "shared" {
+				t.Errorf("Get got %q, %v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("fetch called %d times across replicas, want 1", got)
+	}
+}
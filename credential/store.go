@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package credential
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token is an app-level credential, e.g. a Feishu app_access_token or a WeCom corp access_token
+type Token struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store persists credentials. Use a shared backend (e.g. Redis) so multiple replicas reuse the same credential.
+type Store interface {
+	// Get returns the credential stored for key, or nil if there is none
+	Get(ctx context.Context, key string) (*Token, error)
+	// Set stores the credential for key, it may be dropped once it expires
+	Set(ctx context.Context, key string, token *Token) error
+	// Delete removes the credential stored for key
+	Delete(ctx context.Context, key string) error
+	// SetIfAbsent atomically stores the credential for key unless an unexpired one is stored, it reports whether it was stored
+	SetIfAbsent(ctx context.Context, key string, token *Token) (bool, error)
+	// GetAndDelete atomically removes and returns the credential stored for key, or nil if there is none
+	GetAndDelete(ctx context.Context, key string) (*Token, error)
+}
+
+// Locker is optionally implemented by a shared Store, so that only one replica
+// refreshes a credential at a time while the others wait for the new one.
+type Locker interface {
+	// TryLock acquires the refresh lock for key, it must be released automatically after ttl
+	TryLock(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Unlock releases the refresh lock for key
+	Unlock(ctx context.Context, key string) error
+}
+
+// MemoryStore is a Store kept in the process memory
+type MemoryStore struct {
+	mu     sync.RWMutex
+	tokens map[string]*Token
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tokens: make(map[string]*Token)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, ok := s.tokens[key]
+	if !ok {
+		return nil, nil
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, token *Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *token
+	s.tokens[key] = &copied
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, key)
+	return nil
+}
+
+func (s *MemoryStore) SetIfAbsent(ctx context.Context, key string, token *Token) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// An expired credential is treated as dropped
+	if stored, ok := s.tokens[key]; ok && (stored.ExpiresAt.IsZero() || time.Now().Before(stored.ExpiresAt)) {
+		return false, nil
+	}
+	copied := *token
+	s.tokens[key] = &copied
+	return true, nil
+}
+
+func (s *MemoryStore) GetAndDelete(ctx context.Context, key string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.tokens, key)
+	return token, nil
+}
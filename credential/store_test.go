@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package credential
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSetIfAbsent(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	const n = 50
+	var wg sync.WaitGroup
+	var stored atomic.Int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := store.SetIfAbsent(ctx, "once", &Token{Value: "used", ExpiresAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := stored.Load(); got != 1 {
+		t.Fatalf("SetIfAbsent stored %d times, want 1", got)
+	}
+
+	// An expired credential is replaced
+	store.Set(ctx, "expired", &Token{Value: "old", ExpiresAt: time.Now().Add(-time.Second)})
+	if ok, err := store.SetIfAbsent(ctx, "expired", &Token{Value: "new", ExpiresAt: time.Now().Add(time.Hour)}); err != nil || !ok {
+		t.Fatalf("SetIfAbsent over an expired credential got %v, %v", ok, err)
+	}
+	if token, _ := store.Get(ctx, "expired"); token == nil || token.Value != "new" {
+		t.Fatalf("store holds %+v, want new", token)
+	}
+}
+
+func TestMemoryStoreGetAndDelete(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	store.Set(ctx, "request", &Token{Value: "state"})
+
+	const n = 50
+	var wg sync.WaitGroup
+	var taken atomic.Int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := store.GetAndDelete(ctx, "request")
+			if err != nil {
+				t.Error(err)
+			}
+			if token != nil {
+				taken.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := taken.Load(); got != 1 {
+		t.Fatalf("GetAndDelete returned the credential %d times, want 1", got)
+	}
+	if token, _ := store.Get(ctx, "request"); token != nil {
+		t.Fatalf("store still holds %+v", token)
+	}
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+// Command device signs in with the OAuth 2.0 Device Authorization Grant (RFC 8628),
+// as a CLI or TV app which can not receive a browser redirect would, e.g.
+//
+//	go run ./cmd/device -provider github
+//	go run ./cmd/device -provider oidc
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"go.xiexianbin.cn/authkit"
+	"go.xiexianbin.cn/authkit/types"
+
+	"example/internal/api"
+)
+
+func main() {
+	provider := flag.String("provider", "", "provider supporting the device flow: google, microsoft, github or oidc")
+	flag.Parse()
+
+	if *provider == "" {
+		fmt.Fprintln(os.Stderr, "usage: device -provider <name>")
+		os.Exit(2)
+	}
+
+	api.InitProviders()
+	p, err := authkit.GetProvider(*provider)
+	if err != nil {
+		log.Fatalf("failed to get provider: %s", err)
+	}
+	deviceProvider, ok := p.(types.DeviceAuthProvider)
+	if !ok {
+		log.Fatalf("provider %s does not support the device flow", *provider)
+	}
+
+	ctx := context.Background()
+	da, err := deviceProvider.DeviceAuth(ctx)
+	if err != nil {
+		log.Fatalf("failed to start the device flow: %s", err)
+	}
+	if da.VerificationURIComplete != "" {
+		fmt.Printf("Open %s to sign in (code %s)\n", da.VerificationURIComplete, da.UserCode)
+	} else {
+		fmt.Printf("Open %s and enter the code %s\n", da.VerificationURI, da.UserCode)
+	}
+
+	token, err := deviceProvider.DeviceAccessToken(ctx, da)
+	switch {
+	case errors.Is(err, types.ErrDeviceCodeExpired):
+		log.Fatal("the code expired before it was entered, try again")
+	case errors.Is(err, types.ErrDeviceAccessDenied):
+		log.Fatal("the sign in was denied")
+	case err != nil:
+		log.Fatalf("failed to get token: %s", err)
+	}
+
+	userInfo, err := p.GetUserInfo(ctx, token)
+	if err != nil {
+		log.Fatalf("failed to get user info: %s", err)
+	}
+	fmt.Printf("Signed in as %s (%s, %s id %s)\n", userInfo.Name, userInfo.Email, userInfo.Provider, userInfo.ProviderUserID)
+}
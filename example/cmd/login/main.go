@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+// Command login signs in from the terminal with the browser and a loopback redirect (RFC 8252),
+// as a developer CLI would, e.g.
+//
+//	go run ./cmd/login -provider github
+//	go run ./cmd/login -provider google -no-browser
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"go.xiexianbin.cn/authkit"
+	"go.xiexianbin.cn/authkit/cli"
+
+	"example/internal/api"
+)
+
+func main() {
+	provider := flag.String("provider", "", "provider to sign in with, e.g. github or google")
+	port := flag.Int("port", 0, "loopback port, random by default")
+	noBrowser := flag.Bool("no-browser", false, "print the sign in URL instead of opening the browser")
+	flag.Parse()
+
+	if *provider == "" {
+		fmt.Fprintln(os.Stderr, "usage: login -provider <name> [-port <port>] [-no-browser]")
+		os.Exit(2)
+	}
+
+	api.InitProviders()
+	p, err := authkit.GetProvider(*provider)
+	if err != nil {
+		log.Fatalf("failed to get provider: %s", err)
+	}
+
+	_, userInfo, err := cli.Login(context.Background(), p, cli.Options{
+		Port:      *port,
+		NoBrowser: *noBrowser,
+	})
+	if err != nil {
+		log.Fatalf("failed to sign in: %s", err)
+	}
+	fmt.Printf("Signed in as %s (%s, %s id %s)\n", userInfo.Name, userInfo.Email, userInfo.Provider, userInfo.ProviderUserID)
+}
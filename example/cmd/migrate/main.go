@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+// Command migrate rewrites the provider user IDs of the linked accounts of a provider
+// after its subject identifier strategy changed, e.g.
+//
+//	go run ./cmd/migrate -provider wechat -subject unionid -dry-run
+//	go run ./cmd/migrate -provider microsoft -subject oid,tid
+//	go run ./cmd/migrate -provider wechat -mapping openid_to_unionid.csv
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.xiexianbin.cn/authkit"
+	"go.xiexianbin.cn/authkit/migration"
+
+	"example/internal/api"
+	"example/internal/database"
+	"example/internal/services"
+)
+
+func main() {
+	provider := flag.String("provider", "", "provider whose linked accounts are migrated")
+	subject := flag.String("subject", "", "comma separated alternate ID kinds re-resolved with the stored tokens, e.g. unionid or oid,tid")
+	mapping := flag.String("mapping", "", "CSV (old,new) or JSON ({\"old\": \"new\"}) mapping file, instead of the stored tokens")
+	dryRun := flag.Bool("dry-run", false, "report the changes without writing them")
+	flag.Parse()
+
+	if *provider == "" || (*subject == "") == (*mapping == "") {
+		fmt.Fprintln(os.Stderr, "usage: migrate -provider <name> (-subject <kinds> | -mapping <file>) [-dry-run]")
+		os.Exit(2)
+	}
+
+	var resolver migration.Resolver
+	if *mapping != "" {
+		m, err := migration.LoadMappingFile(*mapping)
+		if err != nil {
+			log.Fatalf("failed to load mapping: %s", err)
+		}
+		resolver = m
+	} else {
+		api.InitProviders()
+		p, err := authkit.GetProvider(*provider)
+		if err != nil {
+			log.Fatalf("failed to get provider: %s", err)
+		}
+		resolver = &migration.ProviderResolver{
+			Provider: p,
+			Subject:  migration.AlternateID(strings.Split(*subject, ",")...),
+		}
+	}
+
+	report, err := migration.Migrate(context.Background(), services.NewAccountStore(database.DB), resolver, migration.Options{
+		Provider: *provider,
+		DryRun:   *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("migration failed: %s", err)
+	}
+
+	for _, change := range report.Changed {
+		fmt.Printf("changed  account %s: %s -> %s\n", change.Account.ID, change.Account.ProviderUserID, change.NewProviderUserID)
+	}
+	for _, conflict := range report.Conflicts {
+		ids := make([]string, 0, len(conflict.ConflictsWith))
+		for _, account := range conflict.ConflictsWith {
+			ids = append(ids, account.ID)
+		}
+		fmt.Printf("conflict account %s: %s -> %s is used by account(s) %s\n",
+			conflict.Account.ID, conflict.Account.ProviderUserID, conflict.NewProviderUserID, strings.Join(ids, ", "))
+	}
+	for _, failure := range report.Failures {
+		fmt.Printf("failed   account %s: %s\n", failure.Account.ID, failure.Err)
+	}
+	fmt.Println(report)
+}
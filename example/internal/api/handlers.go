@@ -7,8 +7,10 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -26,15 +28,33 @@ import (
 type AppConfig struct {
 	Alipay    types.OauthConfig
 	Apple     types.OauthConfig
+	Cas       types.OauthConfig
 	Dingtalk  types.OauthConfig
+	Discord   types.OauthConfig
+	Douyin    types.OauthConfig
 	Facebook  types.OauthConfig
 	Feishu    types.OauthConfig
 	Github    types.OauthConfig
 	Google    types.OauthConfig
+	Huawei    types.OauthConfig
+	Kakao     types.OauthConfig
+	Ldap      types.OauthConfig
+	Line      types.OauthConfig
+	Linkedin  types.OauthConfig
 	Microsoft types.OauthConfig
+	Naver     types.OauthConfig
+	Oidc      types.OauthConfig
 	QQ        types.OauthConfig
+	Saml      types.OauthConfig
+	Slack     types.OauthConfig
+	Steam     types.OauthConfig
+	Telegram  types.OauthConfig
+	Tiktok    types.OauthConfig
 	Twitter   types.OauthConfig
 	Wechat    types.OauthConfig
+	Wecom     types.OauthConfig
+	Weibo     types.OauthConfig
+	Xiaomi    types.OauthConfig
 }
 
 func InitProviders() {
@@ -53,14 +73,30 @@ func InitProviders() {
 	log.Printf("%#v", config)
 
 	if config.Alipay.ClientID != "" {
+		config.Alipay.Extra = map[string]any{
+			"AppPrivateKey":   os.Getenv("ALIPAY_APP_PRIVATE_KEY"),
+			"AlipayPublicKey": os.Getenv("ALIPAY_PUBLIC_KEY"),
+		}
 		authkit.RegisterProvider(types.ALIPAY, providers.NewAlipayProvider(&config.Alipay))
 	}
 	if config.Apple.ClientID != "" {
 		authkit.RegisterProvider(types.APPLE, providers.NewAppleProvider(&config.Apple))
 	}
+	if serverURL := os.Getenv("CAS_SERVER_URL"); serverURL != "" {
+		config.Cas.Extra = map[string]any{
+			"ServerURL": serverURL,
+		}
+		authkit.RegisterProvider(types.CAS, providers.NewCASProvider(&config.Cas))
+	}
 	if config.Dingtalk.ClientID != "" {
 		authkit.RegisterProvider(types.DINGTALK, providers.NewDingtalkProvider(&config.Dingtalk))
 	}
+	if config.Discord.ClientID != "" {
+		authkit.RegisterProvider(types.DISCORD, providers.NewDiscordProvider(&config.Discord))
+	}
+	if config.Douyin.ClientID != "" {
+		authkit.RegisterProvider(types.DOUYIN, providers.NewDouyinProvider(&config.Douyin))
+	}
 	if config.Facebook.ClientID != "" {
 		authkit.RegisterProvider(types.FACEBOOK, providers.NewFacebookProvider(&config.Facebook))
 	}
@@ -73,18 +109,85 @@ func InitProviders() {
 	if config.Google.ClientID != "" {
 		authkit.RegisterProvider(types.GOOGLE, providers.NewGoogleProvider(&config.Google))
 	}
+	if config.Huawei.ClientID != "" {
+		authkit.RegisterProvider(types.HUAWEI, providers.NewHuaweiProvider(&config.Huawei))
+	}
+	if config.Kakao.ClientID != "" {
+		authkit.RegisterProvider(types.KAKAO, providers.NewKakaoProvider(&config.Kakao))
+	}
+	if ldapURL := os.Getenv("LDAP_URL"); ldapURL != "" {
+		config.Ldap.Extra = map[string]any{
+			"URL":          ldapURL,
+			"StartTLS":     os.Getenv("LDAP_START_TLS"),
+			"Insecure":     os.Getenv("LDAP_INSECURE"),
+			"BaseDN":       os.Getenv("LDAP_BASE_DN"),
+			"NestedGroups": os.Getenv("LDAP_NESTED_GROUPS"),
+		}
+		authkit.RegisterCredentialVerifier(types.LDAP, providers.NewLDAPProvider(&config.Ldap))
+	}
+	if config.Line.ClientID != "" {
+		authkit.RegisterProvider(types.LINE, providers.NewLineProvider(&config.Line))
+	}
+	if config.Linkedin.ClientID != "" {
+		authkit.RegisterProvider(types.LINKEDIN, providers.NewLinkedinProvider(&config.Linkedin))
+	}
 	if config.Microsoft.ClientID != "" {
 		authkit.RegisterProvider(types.MICROSOFT, providers.NewMicrosoftProvider(&config.Microsoft))
 	}
+	if config.Naver.ClientID != "" {
+		authkit.RegisterProvider(types.NAVER, providers.NewNaverProvider(&config.Naver))
+	}
+	if config.Oidc.ClientID != "" {
+		config.Oidc.Extra = map[string]any{
+			"Issuer": os.Getenv("OIDC_ISSUER"),
+		}
+		authkit.RegisterProvider(types.OIDC, providers.NewOIDCProvider(&config.Oidc))
+	}
 	if config.QQ.ClientID != "" {
 		authkit.RegisterProvider(types.QQ, providers.NewQQProvider(&config.QQ))
 	}
+	if config.Saml.ClientID != "" {
+		config.Saml.Extra = map[string]any{
+			"IDPMetadataURL": os.Getenv("SAML_IDP_METADATA_URL"),
+			"MetadataURL":    os.Getenv("SAML_METADATA_URL"),
+			"Certificate":    os.Getenv("SAML_CERTIFICATE"),
+			"PrivateKey":     os.Getenv("SAML_PRIVATE_KEY"),
+		}
+		// The IdP posts the SAMLResponse to the verify endpoint (RedirectURL), which is also the IdP-initiated entry
+		samlProvider := providers.NewSAMLProvider(&config.Saml)
+		authkit.RegisterProvider(types.SAML, samlProvider)
+		authkit.RegisterCredentialVerifier(types.SAML, samlProvider)
+	}
+	if config.Slack.ClientID != "" {
+		authkit.RegisterProvider(types.SLACK, providers.NewSlackProvider(&config.Slack))
+	}
+	if config.Steam.RedirectURL != "" {
+		config.Steam.Extra = map[string]any{
+			"APIKey": os.Getenv("STEAM_API_KEY"),
+		}
+		authkit.RegisterProvider(types.STEAM, providers.NewSteamProvider(&config.Steam))
+	}
+	if config.Telegram.ClientSecret != "" {
+		authkit.RegisterCredentialVerifier(types.TELEGRAM, providers.NewTelegramProvider(&config.Telegram))
+	}
+	if config.Tiktok.ClientID != "" {
+		authkit.RegisterProvider(types.TIKTOK, providers.NewTiktokProvider(&config.Tiktok))
+	}
 	if config.Twitter.ClientID != "" {
 		authkit.RegisterProvider(types.TWITTER, providers.NewTwitterProvider(&config.Twitter))
 	}
 	if config.Wechat.ClientID != "" {
 		authkit.RegisterProvider(types.WECHAT, providers.NewWechatProvider(&config.Wechat))
 	}
+	if config.Wecom.ClientID != "" {
+		authkit.RegisterProvider(types.WECOM, providers.NewWecomProvider(&config.Wecom))
+	}
+	if config.Weibo.ClientID != "" {
+		authkit.RegisterProvider(types.WEIBO, providers.NewWeiboProvider(&config.Weibo))
+	}
+	if config.Xiaomi.ClientID != "" {
+		authkit.RegisterProvider(types.XIAOMI, providers.NewXiaomiProvider(&config.Xiaomi))
+	}
 }
 
 type AuthHandler struct {
@@ -111,6 +214,20 @@ func (h *AuthHandler) Home(c *gin.Context) {
 		html += fmt.Sprintf("<a href=\"/api/v1/oauth/%s/login\">Login with %s</a><br/>", name, name)
 	}
 
+	// The Telegram Login Widget needs the bot username, it redirects to the verify endpoint with the signed user data
+	if botName := os.Getenv("TELEGRAM_CLIENT_ID"); botName != "" {
+		html += fmt.Sprintf(`<script async src="https://telegram.org/js/telegram-widget.js?22" data-telegram-login="%s" data-size="large" data-auth-url="/api/v1/oauth/telegram/verify"></script>`, template.HTMLEscapeString(botName))
+	}
+
+	// Directory users submit their username and password to the verify endpoint
+	if _, err := authkit.GetCredentialVerifier(types.LDAP); err == nil {
+		html += `<form method="post" action="/api/v1/oauth/ldap/verify">
+		<input name="username" placeholder="Username"/>
+		<input name="password" type="password" placeholder="Password"/>
+		<button type="submit">Login with LDAP</button>
+	</form>`
+	}
+
 	html += `</body>
 </html>`
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
@@ -186,6 +303,10 @@ func (h *AuthHandler) HandleOauthCallback(c *gin.Context) {
 	}
 
 	code := c.Query("code")
+	if providerName == types.STEAM || providerName == types.CAS {
+		// OpenID 2.0 and CAS have no code, the whole callback query (assertion or ticket) is verified
+		code = c.Request.URL.RawQuery
+	}
 	// Pass VerifierOption to ExchangeCodeForToken
 	token, err := provider.ExchangeCodeForToken(c.Request.Context(), code, oauth2.VerifierOption(codeVerifierCookie))
 	if err != nil {
@@ -229,7 +350,7 @@ func (h *AuthHandler) HandleOauthCallback(c *gin.Context) {
 			return
 		}
 
-		err = h.AuthService.HandleOauthBind(userID, userInfo)
+		err = h.AuthService.HandleOauthBind(userID, userInfo, token)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to bind account: " + err.Error()})
 			return
@@ -241,7 +362,7 @@ func (h *AuthHandler) HandleOauthCallback(c *gin.Context) {
 		return
 	}
 
-	user, err := h.AuthService.HandleOauthLoginOrRegister(userInfo)
+	user, err := h.AuthService.HandleOauthLoginOrRegister(userInfo, token)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process user: " + err.Error()})
 		return
@@ -263,3 +384,64 @@ func (h *AuthHandler) HandleOauthCallback(c *gin.Context) {
 		"user":    user,
 	})
 }
+
+// HandleMetadata serves the metadata of the app as a SAML service provider, to import in the IdP
+func (h *AuthHandler) HandleMetadata(c *gin.Context) {
+	provider, err := authkit.GetProvider(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	samlProvider, ok := provider.(*providers.SAMLProvider)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "provider has no metadata"})
+		return
+	}
+	samlProvider.ServeMetadata(c.Writer, c.Request)
+}
+
+// HandleCredentialLogin handles redirect-less logins, whose signed credentials are verified directly
+func (h *AuthHandler) HandleCredentialLogin(c *gin.Context) {
+	verifier, err := authkit.GetCredentialVerifier(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The Telegram widget either redirects with the credentials in the query or posts them,
+	// SAML IdPs post the SAMLResponse
+	credentials := c.Request.URL.Query()
+	if c.Request.Method == http.MethodPost {
+		if err := c.Request.ParseForm(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		credentials = c.Request.PostForm
+	}
+
+	userInfo, err := verifier.VerifyCredentials(c.Request.Context(), credentials)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify credentials: " + err.Error()})
+		return
+	}
+
+	user, err := h.AuthService.HandleOauthLoginOrRegister(userInfo, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process user: " + err.Error()})
+		return
+	}
+
+	jwtToken, err := utils.GenerateJWT(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT"})
+		return
+	}
+
+	c.SetCookie("jwt_token", jwtToken, 86400, "/", "", false, true)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Login successful",
+		"token":   jwtToken,
+		"user":    user,
+	})
+}
@@ -29,6 +29,13 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB) {
 
 			// Unified callback handling
 			oauthGroup.GET("/callback", authHandler.HandleOauthCallback)
+
+			// Redirect-less logins (e.g. Telegram Login Widget) submit signed credentials
+			oauthGroup.GET("/verify", authHandler.HandleCredentialLogin)
+			oauthGroup.POST("/verify", authHandler.HandleCredentialLogin)
+
+			// SAML service provider metadata
+			oauthGroup.GET("/metadata", authHandler.HandleMetadata)
 		}
 	}
 }
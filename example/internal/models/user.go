@@ -3,7 +3,11 @@
 
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type User struct {
 	gorm.Model
@@ -20,9 +24,13 @@ type OauthAccount struct {
 	UserID         uint   `gorm:"index;not null"`
 	Provider       string `gorm:"type:varchar(50);not null"`
 	ProviderUserID string `gorm:"type:varchar(255);not null"`
-	AccessToken    string `gorm:"type:text"`
-	RefreshToken   string `gorm:"type:text"`
-	ExpiresAt      *gorm.DeletedAt
+	// TenantID is the organization the account signed in with, if any (e.g. DingTalk corpId)
+	TenantID     string `gorm:"type:varchar(255)"`
+	AccessToken  string `gorm:"type:text"`
+	RefreshToken string `gorm:"type:text"`
+	// IDToken is kept for the providers reading claims from it, e.g. the Microsoft oid and tid
+	IDToken   string `gorm:"type:text"`
+	ExpiresAt *time.Time
 
 	// Relationship: Belongs to one user
 	User User `gorm:"foreignKey:UserID"`
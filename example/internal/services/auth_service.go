@@ -7,6 +7,7 @@ import (
 	"fmt"
 
 	"go.xiexianbin.cn/authkit/types"
+	"golang.org/x/oauth2"
 	"gorm.io/gorm"
 
 	"example/internal/models"
@@ -20,14 +21,20 @@ func NewAuthService(db *gorm.DB) *AuthService {
 	return &AuthService{DB: db}
 }
 
-// HandleOauthLoginOrRegister handles the core logic after OAuth callback
-func (s *AuthService) HandleOauthLoginOrRegister(userInfo *types.UserInfo) (*models.User, error) {
+// HandleOauthLoginOrRegister handles the core logic after OAuth callback,
+// token is stored with the account (nil for credential logins, e.g. Telegram or SAML)
+func (s *AuthService) HandleOauthLoginOrRegister(userInfo *types.UserInfo, token *oauth2.Token) (*models.User, error) {
 	var oauthAccount models.OauthAccount
 
 	// 1. Check if the third-party account already exists
 	err := s.DB.Preload("User").Where("provider = ? AND provider_user_id = ?", userInfo.Provider, userInfo.ProviderUserID).First(&oauthAccount).Error
 	if err == nil {
-		// Exists, return the associated local user directly
+		// Exists, keep its token up to date and return the associated local user
+		if token != nil {
+			if err := s.DB.Model(&oauthAccount).Updates(tokenColumns(token)).Error; err != nil {
+				return nil, err
+			}
+		}
 		return &oauthAccount.User, nil
 	}
 
@@ -38,6 +45,33 @@ func (s *AuthService) HandleOauthLoginOrRegister(userInfo *types.UserInfo) (*mod
 	// Transaction processing to ensure data consistency
 	tx := s.DB.Begin()
 
+	// 1.1 The account may have been linked with another identifier of the same user (e.g. openid before unionid),
+	// match it by the alternate IDs and migrate it to the primary subject
+	account, err := findAlternateAccount(tx, userInfo)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if account != nil {
+		columns := map[string]any{
+			"provider_user_id": userInfo.ProviderUserID,
+			"tenant_id":        userInfo.TenantID,
+		}
+		if token != nil {
+			for column, value := range tokenColumns(token) {
+				columns[column] = value
+			}
+		}
+		if err := tx.Model(account).Updates(columns).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return nil, err
+		}
+		return &account.User, nil
+	}
+
 	// 2. Third-party account does not exist, check if email is registered
 	var user models.User
 	var emailErr error
@@ -88,8 +122,9 @@ func (s *AuthService) HandleOauthLoginOrRegister(userInfo *types.UserInfo) (*mod
 		UserID:         user.ID,
 		Provider:       userInfo.Provider,
 		ProviderUserID: userInfo.ProviderUserID,
-		// Optional: store token
+		TenantID:       userInfo.TenantID,
 	}
+	setToken(&newOauthAccount, token)
 
 	if err := tx.Create(&newOauthAccount).Error; err != nil {
 		tx.Rollback()
@@ -105,8 +140,74 @@ func (s *AuthService) HandleOauthLoginOrRegister(userInfo *types.UserInfo) (*mod
 	return &user, nil
 }
 
+// subjectKinds are the identifier kinds providers use as subject, which an account may have been linked with.
+// The other alternate IDs (e.g. Microsoft tid, LDAP dn) never identify an account on their own.
+var subjectKinds = []struct {
+	kind string
+	// tenantScoped kinds are only unique within a tenant, they only match an account of the same tenant
+	tenantScoped bool
+}{
+	{types.SubjectUnionID, false},
+	{types.SubjectOpenID, false},
+	{types.SubjectUserID, true},
+}
+
+// findAlternateAccount returns the account of the provider linked with one of the alternate subjects of userInfo, if any
+func findAlternateAccount(tx *gorm.DB, userInfo *types.UserInfo) (*models.OauthAccount, error) {
+	for _, subject := range subjectKinds {
+		alternateID := userInfo.AlternateIDs[subject.kind]
+		if alternateID == "" || alternateID == userInfo.ProviderUserID {
+			continue
+		}
+
+		query := tx.Preload("User").Where("provider = ? AND provider_user_id = ?", userInfo.Provider, alternateID)
+		if subject.tenantScoped {
+			if userInfo.TenantID == "" {
+				continue
+			}
+			query = query.Where("tenant_id = ?", userInfo.TenantID)
+		}
+
+		var oauthAccount models.OauthAccount
+		err := query.First(&oauthAccount).Error
+		if err == nil {
+			return &oauthAccount, nil
+		}
+		if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// setToken stores token in the account, so that it can be used later (e.g. by cmd/migrate)
+func setToken(account *models.OauthAccount, token *oauth2.Token) {
+	if token == nil {
+		return
+	}
+	account.AccessToken = token.AccessToken
+	account.RefreshToken = token.RefreshToken
+	account.IDToken, _ = token.Extra("id_token").(string)
+	if !token.Expiry.IsZero() {
+		expiresAt := token.Expiry
+		account.ExpiresAt = &expiresAt
+	}
+}
+
+// tokenColumns returns the token columns of an existing account to update
+func tokenColumns(token *oauth2.Token) map[string]any {
+	var account models.OauthAccount
+	setToken(&account, token)
+	return map[string]any{
+		"access_token":  account.AccessToken,
+		"refresh_token": account.RefreshToken,
+		"id_token":      account.IDToken,
+		"expires_at":    account.ExpiresAt,
+	}
+}
+
 // HandleOauthBind specifically handles binding a new OAuth info to an existing User
-func (s *AuthService) HandleOauthBind(userID uint, userInfo *types.UserInfo) error {
+func (s *AuthService) HandleOauthBind(userID uint, userInfo *types.UserInfo, token *oauth2.Token) error {
 	var oauthAccount models.OauthAccount
 
 	// Check if this specific oauth provider record already exists globally
@@ -140,7 +241,9 @@ func (s *AuthService) HandleOauthBind(userID uint, userInfo *types.UserInfo) err
 		UserID:         userID,
 		Provider:       userInfo.Provider,
 		ProviderUserID: userInfo.ProviderUserID,
+		TenantID:       userInfo.TenantID,
 	}
+	setToken(&newOauthAccount, token)
 
 	return s.DB.Create(&newOauthAccount).Error
 }
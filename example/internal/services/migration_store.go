@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package services
+
+import (
+	"context"
+	"strconv"
+
+	"go.xiexianbin.cn/authkit/migration"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+
+	"example/internal/models"
+)
+
+// AccountStore implements migration.Store over the OauthAccount table
+type AccountStore struct {
+	DB *gorm.DB
+}
+
+func NewAccountStore(db *gorm.DB) *AccountStore {
+	return &AccountStore{DB: db}
+}
+
+func (s *AccountStore) ListAccounts(ctx context.Context, provider string) ([]migration.Account, error) {
+	var oauthAccounts []models.OauthAccount
+	if err := s.DB.WithContext(ctx).Where("provider = ?", provider).Order("id").Find(&oauthAccounts).Error; err != nil {
+		return nil, err
+	}
+
+	accounts := make([]migration.Account, 0, len(oauthAccounts))
+	for _, oauthAccount := range oauthAccounts {
+		account := migration.Account{
+			ID:             strconv.FormatUint(uint64(oauthAccount.ID), 10),
+			Provider:       oauthAccount.Provider,
+			ProviderUserID: oauthAccount.ProviderUserID,
+		}
+		if oauthAccount.AccessToken != "" {
+			token := &oauth2.Token{
+				AccessToken:  oauthAccount.AccessToken,
+				RefreshToken: oauthAccount.RefreshToken,
+			}
+			if oauthAccount.ExpiresAt != nil {
+				token.Expiry = *oauthAccount.ExpiresAt
+			}
+			if oauthAccount.IDToken != "" {
+				token = token.WithExtra(map[string]any{"id_token": oauthAccount.IDToken})
+			}
+			account.Token = token
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+func (s *AccountStore) UpdateProviderUserIDs(ctx context.Context, changes []migration.Change) error {
+	return s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, change := range changes {
+			id, err := strconv.ParseUint(change.Account.ID, 10, 64)
+			if err != nil {
+				return err
+			}
+			// Match the old ID too, so an account linked again meanwhile is not overwritten
+			err = tx.Model(&models.OauthAccount{}).
+				Where("id = ? AND provider_user_id = ?", id, change.Account.ProviderUserID).
+				Update("provider_user_id", change.NewProviderUserID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -14,6 +14,9 @@ var (
 	mu            sync.RWMutex
 	registry      = make(map[string]types.Provider)
 	providerNames = make([]string, 0)
+
+	verifiers     = make(map[string]types.CredentialVerifier)
+	verifierNames = make([]string, 0)
 )
 
 // RegisterProvider registers a new OAuth provider.
@@ -46,3 +49,34 @@ func GetProviders() []string {
 	copy(names, providerNames)
 	return names
 }
+
+// RegisterCredentialVerifier registers a new redirect-less login, such as the Telegram Login Widget.
+// It is thread-safe and can be called at init or runtime.
+func RegisterCredentialVerifier(name string, v types.CredentialVerifier) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := verifiers[name]; !exists {
+		verifierNames = append(verifierNames, name)
+	}
+	verifiers[name] = v
+}
+
+// GetCredentialVerifier get a CredentialVerifier instance by name
+func GetCredentialVerifier(name string) (types.CredentialVerifier, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	verifier, ok := verifiers[name]
+	if !ok {
+		return nil, fmt.Errorf("credential verifier %s not supported", name)
+	}
+	return verifier, nil
+}
+
+// GetCredentialVerifiers returns a list of registered credential verifier names in order of registration
+func GetCredentialVerifiers() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, len(verifierNames))
+	copy(names, verifierNames)
+	return names
+}
@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+// Package migration rewrites the provider user IDs of linked accounts when the
+// subject identifier strategy of a provider changes, e.g. WeChat openid to unionid
+// or Microsoft `id` to `oid`+`tid`.
+//
+// The application implements Store over its linked accounts table, picks a Resolver
+// (stored tokens or a mapping file) and calls Migrate, optionally as a dry run.
+package migration
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// Account is a linked third-party account as stored by the application
+type Account struct {
+	// ID is the application primary key of the linked account
+	ID             string
+	Provider       string
+	ProviderUserID string
+	// Token is the stored provider token, if any, used by ProviderResolver
+	Token *oauth2.Token
+}
+
+// Store is implemented by the application over its linked accounts
+type Store interface {
+	// ListAccounts returns all the accounts linked to provider
+	ListAccounts(ctx context.Context, provider string) ([]Account, error)
+	// UpdateProviderUserIDs rewrites the provider user ID of every change in a single transaction
+	UpdateProviderUserIDs(ctx context.Context, changes []Change) error
+}
+
+// Change is an account whose provider user ID is rewritten
+type Change struct {
+	Account           Account
+	NewProviderUserID string
+}
+
+// Conflict is an account which can not be rewritten because its new provider user ID
+// is, or would be, used by other accounts of the same provider
+type Conflict struct {
+	Account           Account
+	NewProviderUserID string
+	ConflictsWith     []Account
+}
+
+// Failure is an account whose new provider user ID could not be resolved
+type Failure struct {
+	Account Account
+	Err     error
+}
+
+// Report is the outcome of a migration
+type Report struct {
+	Provider  string
+	DryRun    bool
+	Changed   []Change
+	Unchanged []Account
+	Conflicts []Conflict
+	Failures  []Failure
+}
+
+// String summarizes the report
+func (r *Report) String() string {
+	mode := ""
+	if r.DryRun {
+		mode = " (dry-run)"
+	}
+	return fmt.Sprintf("%s%s: %d changed, %d unchanged, %d conflicts, %d failures",
+		r.Provider, mode, len(r.Changed), len(r.Unchanged), len(r.Conflicts), len(r.Failures))
+}
+
+// Options configures a migration
+type Options struct {
+	// Provider is the name of the provider whose accounts are migrated
+	Provider string
+	// DryRun resolves and reports the changes without writing them
+	DryRun bool
+}
+
+// Migrate re-resolves the provider user ID of every account of opts.Provider and rewrites
+// the changed ones in a single transaction. Accounts whose new ID collides with another account
+// are reported as conflicts and left untouched, accounts which can not be resolved as failures.
+func Migrate(ctx context.Context, store Store, resolver Resolver, opts Options) (*Report, error) {
+	if opts.Provider == "" {
+		return nil, fmt.Errorf("migration provider is required")
+	}
+
+	accounts, err := store.ListAccounts(ctx, opts.Provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s accounts: %w", opts.Provider, err)
+	}
+
+	report := &Report{Provider: opts.Provider, DryRun: opts.DryRun}
+
+	// Resolve the new ID of each account, accounts which do not change keep their ID
+	resolved := make([]string, len(accounts))
+	pending := make(map[int]bool)
+	for i, account := range accounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		newID, err := resolver.Resolve(ctx, account)
+		switch {
+		case err != nil:
+			report.Failures = append(report.Failures, Failure{Account: account, Err: err})
+			resolved[i] = account.ProviderUserID
+		case newID == "" || newID == account.ProviderUserID:
+			report.Unchanged = append(report.Unchanged, account)
+			resolved[i] = account.ProviderUserID
+		default:
+			resolved[i] = newID
+			pending[i] = true
+		}
+	}
+
+	// Drop the changes colliding with another account until the final IDs are unique.
+	// Reverting a change may create a new collision with its old ID, hence the loop.
+	for {
+		owners := make(map[string][]int)
+		for i := range accounts {
+			owners[resolved[i]] = append(owners[resolved[i]], i)
+		}
+
+		reverted := false
+		for i := range accounts {
+			if !pending[i] || len(owners[resolved[i]]) < 2 {
+				continue
+			}
+			var others []Account
+			for _, j := range owners[resolved[i]] {
+				if j != i {
+					others = append(others, accounts[j])
+				}
+			}
+			report.Conflicts = append(report.Conflicts, Conflict{
+				Account:           accounts[i],
+				NewProviderUserID: resolved[i],
+				ConflictsWith:     others,
+			})
+			resolved[i] = accounts[i].ProviderUserID
+			delete(pending, i)
+			reverted = true
+		}
+		if !reverted {
+			break
+		}
+	}
+
+	for i, account := range accounts {
+		if pending[i] {
+			report.Changed = append(report.Changed, Change{Account: account, NewProviderUserID: resolved[i]})
+		}
+	}
+
+	if opts.DryRun || len(report.Changed) == 0 {
+		return report, nil
+	}
+	if err := store.UpdateProviderUserIDs(ctx, report.Changed); err != nil {
+		return report, fmt.Errorf("failed to update %s accounts: %w", opts.Provider, err)
+	}
+	return report, nil
+}
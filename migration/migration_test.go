@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package migration
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// memoryStore is an in-memory Store of linked accounts
+type memoryStore struct {
+	accounts []Account
+	// updates are the change sets written by UpdateProviderUserIDs
+	updates [][]Change
+}
+
+func (s *memoryStore) ListAccounts(ctx context.Context, provider string) ([]Account, error) {
+	var accounts []Account
+	for _, account := range s.accounts {
+		if account.Provider == provider {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+func (s *memoryStore) UpdateProviderUserIDs(ctx context.Context, changes []Change) error {
+	s.updates = append(s.updates, changes)
+	for _, change := range changes {
+		for i := range s.accounts {
+			if s.accounts[i].ID == change.Account.ID {
+				s.accounts[i].ProviderUserID = change.NewProviderUserID
+			}
+		}
+	}
+	return nil
+}
+
+func newMemoryStore(ids ...string) *memoryStore {
+	store := &memoryStore{}
+	for i, id := range ids {
+		store.accounts = append(store.accounts, Account{ID: string(rune('a' + i)), Provider: "wechat", ProviderUserID: id})
+	}
+	// Accounts of other providers are never listed
+	store.accounts = append(store.accounts, Account{ID: "z", Provider: "qq", ProviderUserID: "openid-1"})
+	return store
+}
+
+// providerUserIDs returns the provider user ID of each wechat account, by ID
+func (s *memoryStore) providerUserIDs() map[string]string {
+	ids := make(map[string]string)
+	for _, account := range s.accounts {
+		if account.Provider == "wechat" {
+			ids[account.ID] = account.ProviderUserID
+		}
+	}
+	return ids
+}
+
+func TestMigrate(t *testing.T) {
+	store := newMemoryStore("openid-1", "openid-2", "openid-3")
+	resolver := MappingResolver{"openid-1": "unionid-1", "openid-2": "unionid-2"}
+
+	report, err := Migrate(context.Background(), store, resolver, Options{Provider: "wechat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 2 || len(report.Unchanged) != 1 || len(report.Conflicts) != 0 || len(report.Failures) != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	if len(store.updates) != 1 {
+		t.Fatalf("%d updates, want a single transaction", len(store.updates))
+	}
+	want := map[string]string{"a": "unionid-1", "b": "unionid-2", "c": "openid-3"}
+	for id, providerUserID := range store.providerUserIDs() {
+		if want[id] != providerUserID {
+			t.Fatalf("account %s has %s, want %s", id, providerUserID, want[id])
+		}
+	}
+	if got := report.String(); got != "wechat: 2 changed, 1 unchanged, 0 conflicts, 0 failures" {
+		t.Fatalf("report = %q", got)
+	}
+}
+
+func TestMigrateConflicts(t *testing.T) {
+	tests := []struct {
+		name          string
+		ids           []string
+		mapping       MappingResolver
+		wantConflicts map[string]string // account ID -> the ID of an account it conflicts with
+		wantChanged   []string
+	}{
+		{
+			name:          "two accounts resolve to the same ID",
+			ids:           []string{"openid-1", "openid-2", "openid-3"},
+			mapping:       MappingResolver{"openid-1": "unionid-1", "openid-2": "unionid-1", "openid-3": "unionid-3"},
+			wantConflicts: map[string]string{"a": "b", "b": "a"},
+			wantChanged:   []string{"c"},
+		},
+		{
+			name:          "new ID used by an untouched account",
+			ids:           []string{"openid-1", "unionid-1"},
+			mapping:       MappingResolver{"openid-1": "unionid-1"},
+			wantConflicts: map[string]string{"a": "b"},
+		},
+		{
+			// b can not move to a's old ID once a is reverted
+			name:          "reverted change frees no ID",
+			ids:           []string{"openid-1", "openid-2", "unionid-1"},
+			mapping:       MappingResolver{"openid-1": "unionid-1", "openid-2": "openid-1"},
+			wantConflicts: map[string]string{"a": "c", "b": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore(tt.ids...)
+			before := store.providerUserIDs()
+
+			report, err := Migrate(context.Background(), store, tt.mapping, Options{Provider: "wechat"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(report.Conflicts) != len(tt.wantConflicts) {
+				t.Fatalf("conflicts = %+v, want %v", report.Conflicts, tt.wantConflicts)
+			}
+			for _, conflict := range report.Conflicts {
+				with := tt.wantConflicts[conflict.Account.ID]
+				if len(conflict.ConflictsWith) == 0 || conflict.ConflictsWith[0].ID != with {
+					t.Fatalf("account %s conflicts with %+v, want %s", conflict.Account.ID, conflict.ConflictsWith, with)
+				}
+				// Conflicting accounts are left untouched
+				if after := store.providerUserIDs()[conflict.Account.ID]; after != before[conflict.Account.ID] {
+					t.Fatalf("conflicting account %s was rewritten to %s", conflict.Account.ID, after)
+				}
+			}
+
+			if len(report.Changed) != len(tt.wantChanged) {
+				t.Fatalf("changed = %+v, want %v", report.Changed, tt.wantChanged)
+			}
+			for i, change := range report.Changed {
+				if change.Account.ID != tt.wantChanged[i] {
+					t.Fatalf("changed account %s, want %s", change.Account.ID, tt.wantChanged[i])
+				}
+			}
+
+			// The final IDs are unique
+			seen := make(map[string]bool)
+			for _, providerUserID := range store.providerUserIDs() {
+				if seen[providerUserID] {
+					t.Fatalf("%s is used by several accounts", providerUserID)
+				}
+				seen[providerUserID] = true
+			}
+		})
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	store := newMemoryStore("openid-1")
+
+	report, err := Migrate(context.Background(), store, MappingResolver{"openid-1": "unionid-1"}, Options{Provider: "wechat", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 1 || report.Changed[0].NewProviderUserID != "unionid-1" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(store.updates) != 0 {
+		t.Fatalf("dry run wrote %d updates", len(store.updates))
+	}
+	if got := report.String(); got != "wechat (dry-run): 1 changed, 0 unchanged, 0 conflicts, 0 failures" {
+		t.Fatalf("report = %q", got)
+	}
+}
+
+func TestMigrateFailures(t *testing.T) {
+	store := newMemoryStore("openid-1", "openid-2")
+	errNoToken := errors.New("no stored token")
+	resolver := ResolverFunc(func(ctx context.Context, account Account) (string, error) {
+		if account.ID == "a" {
+			return "", errNoToken
+		}
+		return "unionid-2", nil
+	})
+
+	report, err := Migrate(context.Background(), store, resolver, Options{Provider: "wechat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failures) != 1 || report.Failures[0].Account.ID != "a" || !errors.Is(report.Failures[0].Err, errNoToken) {
+		t.Fatalf("failures = %+v", report.Failures)
+	}
+	if len(report.Changed) != 1 || report.Changed[0].Account.ID != "b" {
+		t.Fatalf("changed = %+v", report.Changed)
+	}
+	if ids := store.providerUserIDs(); ids["a"] != "openid-1" || ids["b"] != "unionid-2" {
+		t.Fatalf("accounts = %v", ids)
+	}
+}
+
+func TestMigrateProviderRequired(t *testing.T) {
+	store := newMemoryStore("openid-1")
+	if _, err := Migrate(context.Background(), store, MappingResolver{}, Options{}); err == nil {
+		t.Fatal("Migrate without provider succeeded")
+	}
+}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package migration
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Resolver returns the new provider user ID of a stored account.
+// An empty ID, or the current one, means the account does not change.
+type Resolver interface {
+	Resolve(ctx context.Context, account Account) (string, error)
+}
+
+// ResolverFunc adapts a function to the Resolver interface
+type ResolverFunc func(ctx context.Context, account Account) (string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, account Account) (string, error) {
+	return f(ctx, account)
+}
+
+// ProviderResolver re-resolves accounts by calling GetUserInfo with their stored token
+type ProviderResolver struct {
+	Provider types.Provider
+	// Subject picks the new ID from the user info, UserInfo.ProviderUserID is used if nil
+	Subject func(userInfo *types.UserInfo) (string, error)
+}
+
+func (r *ProviderResolver) Resolve(ctx context.Context, account Account) (string, error) {
+	if account.Token == nil || account.Token.AccessToken == "" {
+		return "", fmt.Errorf("no stored token for account %s", account.ID)
+	}
+
+	userInfo, err := r.Provider.GetUserInfo(ctx, account.Token)
+	if err != nil {
+		return "", err
+	}
+
+	if r.Subject == nil {
+		return userInfo.ProviderUserID, nil
+	}
+	return r.Subject(userInfo)
+}
+
+// AlternateID returns a ProviderResolver.Subject picking UserInfo.AlternateIDs of the given kinds,
+// joined by ":" when several are given (e.g. AlternateID("oid", "tid") for the Microsoft `<oid>:<tid>` subject)
+func AlternateID(kinds ...string) func(userInfo *types.UserInfo) (string, error) {
+	return func(userInfo *types.UserInfo) (string, error) {
+		values := make([]string, 0, len(kinds))
+		for _, kind := range kinds {
+			value := userInfo.AlternateIDs[kind]
+			if value == "" {
+				return "", fmt.Errorf("%s %s is not available for user %s", userInfo.Provider, kind, userInfo.ProviderUserID)
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ":"), nil
+	}
+}
+
+// MappingResolver maps current provider user IDs to new ones, e.g. from an export of the vendor.
+// Accounts missing from the mapping are left unchanged.
+type MappingResolver map[string]string
+
+func (m MappingResolver) Resolve(ctx context.Context, account Account) (string, error) {
+	return m[account.ProviderUserID], nil
+}
+
+// LoadMapping reads a mapping either as a JSON object `{"old": "new"}` or as CSV lines `old,new`
+func LoadMapping(r io.Reader) (MappingResolver, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make(MappingResolver)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &mapping); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON mapping: %w", err)
+		}
+		return mapping, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV mapping: %w", err)
+	}
+	for _, record := range records {
+		mapping[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+	}
+	return mapping, nil
+}
+
+// LoadMappingFile reads a mapping file, see LoadMapping
+func LoadMappingFile(path string) (MappingResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadMapping(f)
+}
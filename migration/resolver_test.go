@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package migration
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+func TestLoadMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    MappingResolver
+		wantErr bool
+	}{
+		{name: "JSON", data: ` {"openid-1": "unionid-1", "openid-2": "unionid-2"}`, want: MappingResolver{"openid-1": "unionid-1", "openid-2": "unionid-2"}},
+		{name: "CSV", data: "# old,new\nopenid-1, unionid-1\nopenid-2,unionid-2 \n", want: MappingResolver{"openid-1": "unionid-1", "openid-2": "unionid-2"}},
+		{name: "empty", data: "", want: MappingResolver{}},
+		{name: "invalid JSON", data: `{"openid-1": 1}`, wantErr: true},
+		{name: "CSV with a missing column", data: "openid-1,unionid-1\nopenid-2\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapping, err := LoadMapping(strings.NewReader(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadMapping succeeded with %v", mapping)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mapping) != len(tt.want) {
+				t.Fatalf("mapping = %v, want %v", mapping, tt.want)
+			}
+			for old, new := range tt.want {
+				if mapping[old] != new {
+					t.Fatalf("mapping = %v, want %v", mapping, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// stubProvider returns a user with the alternate IDs of its access token
+type stubProvider struct {
+	types.Provider
+	users map[string]*types.UserInfo
+}
+
+func (p *stubProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	return p.users[token.AccessToken], nil
+}
+
+func TestProviderResolver(t *testing.T) {
+	provider := &stubProvider{users: map[string]*types.UserInfo{
+		"token-1": {
+			Provider:       "microsoft",
+			ProviderUserID: "graph-id",
+			AlternateIDs:   map[string]string{"oid": "oid-1", "tid": "tid-1"},
+		},
+	}}
+	ctx := context.Background()
+	account := Account{ID: "1", Provider: "microsoft", ProviderUserID: "graph-id", Token: &oauth2.Token{AccessToken: "token-1"}}
+
+	newID, err := (&ProviderResolver{Provider: provider}).Resolve(ctx, account)
+	if err != nil || newID != "graph-id" {
+		t.Fatalf("Resolve = %q, %v, want the ProviderUserID", newID, err)
+	}
+
+	resolver := &ProviderResolver{Provider: provider, Subject: AlternateID("oid", "tid")}
+	if newID, err := resolver.Resolve(ctx, account); err != nil || newID != "oid-1:tid-1" {
+		t.Fatalf("Resolve = %q, %v, want oid-1:tid-1", newID, err)
+	}
+
+	if _, err := (&ProviderResolver{Provider: provider, Subject: AlternateID("unionid")}).Resolve(ctx, account); err == nil {
+		t.Fatal("Resolve succeeded without the unionid")
+	}
+	if _, err := resolver.Resolve(ctx, Account{ID: "2", Provider: "microsoft"}); err == nil {
+		t.Fatal("Resolve succeeded without a stored token")
+	}
+}
@@ -5,51 +5,344 @@ package providers
 
 import (
 	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 
 	"go.xiexianbin.cn/authkit/types"
 )
 
+// Alipay does not implement OAuth2 token exchange, every call goes through the signed open API gateway.
+//
+// **Key points**:
+// * Requests are signed with RSA2 (SHA256withRSA) by the app private key `Extra["AppPrivateKey"]`.
+// * Responses are verified with the Alipay public key `Extra["AlipayPublicKey"]` (not the app public key).
+// * `alipay.system.oauth.token` exchanges the `auth_code`, then `alipay.user.info.share` returns the profile.
+// * `Extra["Sandbox"]` switches to the Alipay sandbox environment.
+
 type AlipayProvider struct {
-	Name   string
-	config *oauth2.Config
+	Name            string
+	config          *oauth2.Config
+	gatewayURL      string
+	privateKey      *rsa.PrivateKey
+	alipayPublicKey *rsa.PublicKey
+	keyErr          error
+	subjectKind     string
 }
 
+// NewAlipayProvider creates a new Alipay Provider instance
+//
+// Extra fields: `AppPrivateKey` (PEM or base64 PKCS#1/PKCS#8 private key), `AlipayPublicKey` (PEM or base64 public key),
+// `Sandbox` and `SubjectID` (`user_id` or `openid`).
 func NewAlipayProvider(cfg *types.OauthConfig) types.Provider {
-	return &AlipayProvider{
-		Name: types.ALIPAY,
+	authURL, gatewayURL := "https://openauth.alipay.com/oauth2/publicAppAuthorize.htm", "https://openapi.alipay.com/gateway.do"
+	if extraBool(cfg, "Sandbox") {
+		authURL, gatewayURL = "https://openauth-sandbox.dl.alipaydev.com/oauth2/publicAppAuthorize.htm", "https://openapi-sandbox.dl.alipaydev.com/gateway.do"
+	}
+
+	p := &AlipayProvider{
+		Name:        types.ALIPAY,
+		gatewayURL:  gatewayURL,
+		subjectKind: extraString(cfg, "SubjectID"),
 		config: &oauth2.Config{
 			ClientID:    cfg.ClientID,
 			RedirectURL: cfg.RedirectURL,
 			Scopes:      []string{"auth_user"},
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://openauth.alipay.com/oauth2/publicAppAuthorize.htm",
-				TokenURL: "https://openapi.alipay.com/gateway.do",
+				AuthURL:  authURL,
+				TokenURL: gatewayURL,
 			},
 		},
 	}
+
+	// Key errors are reported on the first gateway call, as the constructor can not fail
+	p.privateKey, p.keyErr = parseAlipayPrivateKey(extraString(cfg, "AppPrivateKey"))
+	if p.keyErr == nil {
+		p.alipayPublicKey, p.keyErr = parseAlipayPublicKey(extraString(cfg, "AlipayPublicKey"))
+	}
+	return p
 }
 
 func (p *AlipayProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
-	return p.config.AuthCodeURL(state, opts...)
+	// Alipay uses app_id instead of client_id and does not support PKCE
+	params := url.Values{
+		"app_id":       {p.config.ClientID},
+		"scope":        {strings.Join(p.config.Scopes, ",")},
+		"redirect_uri": {p.config.RedirectURL},
+		"state":        {state},
+	}
+	return p.config.Endpoint.AuthURL + "?" + params.Encode()
 }
 
 func (p *AlipayProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
-	// Simplified implementation as per original code
-	fmt.Println("Warning: Alipay ExchangeCodeForToken is a dummy implementation.")
-	return &oauth2.Token{AccessToken: code}, nil
+	var tokenData struct {
+		UserID       string `json:"user_id"`
+		OpenID       string `json:"open_id"`
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	params := map[string]string{
+		"grant_type": "authorization_code",
+		"code":       code,
+	}
+	if err := p.call(ctx, "alipay.system.oauth.token", params, &tokenData); err != nil {
+		return nil, err
+	}
+
+	if tokenData.AccessToken == "" {
+		return nil, fmt.Errorf("alipay token error: empty access_token")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}
+	// Store user_id/open_id in Extra
+	return token.WithExtra(map[string]interface{}{
+		"user_id": tokenData.UserID,
+		"open_id": tokenData.OpenID,
+	}), nil
 }
 
 func (p *AlipayProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
-	fmt.Println("Warning: Alipay GetUserInfo is a dummy implementation.")
-	// Original code assumed "user_id" in extra, which comes from real exchange.
-	// We'll return dummy data.
+	var alipayUser struct {
+		Code     string `json:"code"`
+		Msg      string `json:"msg"`
+		SubCode  string `json:"sub_code"`
+		SubMsg   string `json:"sub_msg"`
+		UserID   string `json:"user_id"`
+		OpenID   string `json:"open_id"`
+		NickName string `json:"nick_name"`
+		Avatar   string `json:"avatar"`
+		Province string `json:"province"`
+		City     string `json:"city"`
+		Gender   string `json:"gender"`
+	}
+
+	params := map[string]string{
+		"auth_token": token.AccessToken,
+	}
+	if err := p.call(ctx, "alipay.user.info.share", params, &alipayUser); err != nil {
+		return nil, err
+	}
+
+	if alipayUser.Code != "10000" {
+		return nil, fmt.Errorf("alipay error: %s %s %s %s", alipayUser.Code, alipayUser.Msg, alipayUser.SubCode, alipayUser.SubMsg)
+	}
+
+	// Older apps get user_id, apps created after the open_id migration only get open_id
+	if alipayUser.UserID == "" {
+		alipayUser.UserID, _ = token.Extra("user_id").(string)
+	}
+	if alipayUser.OpenID == "" {
+		alipayUser.OpenID, _ = token.Extra("open_id").(string)
+	}
+
+	ids := compactIDs(map[string]string{
+		types.SubjectUserID: alipayUser.UserID,
+		types.SubjectOpenID: alipayUser.OpenID,
+	})
+	providerUserID, err := selectSubject("alipay", p.subjectKind, ids, types.SubjectUserID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
+	}
+
 	return &types.UserInfo{
 		Provider:       p.Name,
-		ProviderUserID: "dummy_alipay_user_id",
-		Name:           "Alipay User",
-		RawData:        nil,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		Name:           alipayUser.NickName,
+		AvatarURL:      alipayUser.Avatar,
+		Email:          "", // Alipay does not provide email
+		RawData:        alipayUser,
 	}, nil
 }
+
+// call invokes an Alipay open API method through the gateway, verifies the response signature
+// and decodes the `<method>_response` node into out
+func (p *AlipayProvider) call(ctx context.Context, method string, bizParams map[string]string, out any) error {
+	if p.keyErr != nil {
+		return p.keyErr
+	}
+
+	params := map[string]string{
+		"app_id":    p.config.ClientID,
+		"method":    method,
+		"format":    "JSON",
+		"charset":   "utf-8",
+		"sign_type": "RSA2",
+		"timestamp": time.Now().In(time.FixedZone("CST", 8*3600)).Format("2006-01-02 15:04:05"),
+		"version":   "1.0",
+	}
+	for k, v := range bizParams {
+		params[k] = v
+	}
+
+	sign, err := p.sign(params)
+	if err != nil {
+		return err
+	}
+
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	values.Set("sign", sign)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.gatewayURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// json.RawMessage keeps the exact bytes of each node, which is what Alipay signs
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+
+	if errResp, ok := envelope["error_response"]; ok {
+		var alipayErr struct {
+			Code    string `json:"code"`
+			Msg     string `json:"msg"`
+			SubCode string `json:"sub_code"`
+			SubMsg  string `json:"sub_msg"`
+		}
+		if err := json.Unmarshal(errResp, &alipayErr); err != nil {
+			return err
+		}
+		return fmt.Errorf("alipay error: %s %s %s %s", alipayErr.Code, alipayErr.Msg, alipayErr.SubCode, alipayErr.SubMsg)
+	}
+
+	content, ok := envelope[strings.ReplaceAll(method, ".", "_")+"_response"]
+	if !ok {
+		return fmt.Errorf("alipay error: unexpected response: %s", string(body))
+	}
+
+	var signature string
+	if err := json.Unmarshal(envelope["sign"], &signature); err != nil || signature == "" {
+		return fmt.Errorf("alipay error: response is not signed")
+	}
+	if err := p.verify(content, signature); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, out)
+}
+
+// sign signs the request parameters with RSA2: sorted `key=value` pairs joined by `&`, empty values excluded
+func (p *AlipayProvider) sign(params map[string]string) (string, error) {
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if k == "sign" || v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+params[k])
+	}
+
+	hashed := sha256.Sum256([]byte(strings.Join(pairs, "&")))
+	signature, err := rsa.SignPKCS1v15(nil, p.privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign alipay request: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// verify checks the RSA2 signature of a response node with the Alipay public key
+func (p *AlipayProvider) verify(content []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode alipay response signature: %w", err)
+	}
+	hashed := sha256.Sum256(content)
+	if err := rsa.VerifyPKCS1v15(p.alipayPublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		return fmt.Errorf("failed to verify alipay response signature: %w", err)
+	}
+	return nil
+}
+
+// decodeAlipayKey accepts a PEM block or the bare base64 key content exported by the Alipay key tool
+func decodeAlipayKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(strings.ReplaceAll(key, `\n`, "\n"))
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(key)
+}
+
+func parseAlipayPrivateKey(key string) (*rsa.PrivateKey, error) {
+	if key == "" {
+		return nil, fmt.Errorf("AppPrivateKey not found in extra config")
+	}
+	der, err := decodeAlipayKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode alipay private key: %w", err)
+	}
+	if privateKey, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return privateKey, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse alipay private key: %w", err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("alipay private key is not an RSA key")
+	}
+	return privateKey, nil
+}
+
+func parseAlipayPublicKey(key string) (*rsa.PublicKey, error) {
+	if key == "" {
+		return nil, fmt.Errorf("AlipayPublicKey not found in extra config")
+	}
+	der, err := decodeAlipayKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode alipay public key: %w", err)
+	}
+	if publicKey, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return publicKey, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse alipay public key: %w", err)
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("alipay public key is not an RSA key")
+	}
+	return publicKey, nil
+}
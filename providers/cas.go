@@ -0,0 +1,364 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/credential"
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Apereo CAS is not OAuth, its 2.0/3.0 protocol is mapped on the Provider interface as follows.
+//
+// **Key points**:
+// * GetAuthURL redirects to `{ServerURL}/login?service=`, the service is the RedirectURL with the state added to its query.
+// * The CAS server redirects back with a `ticket`: the raw query string of the callback request (`ticket` and `state`)
+//   is passed as the code to ExchangeCodeForToken, which validates the ticket at `/p3/serviceValidate`
+//   (`/serviceValidate` with `Extra["Version"] = "2"`) for the same service.
+// * The token AccessToken is the service ticket, which is also the session index of single logout requests
+//   (see ParseCASLogoutRequest). GetUserInfo reads the validated user from the token, without any request.
+// * Proxy: with `Extra["ProxyCallbackURL"]` a proxy-granting ticket is requested, the CAS server delivers it to
+//   HandleProxyCallback (kept in `Extra["ProxyTicketStore"]`, a credential.Store) and ProxyTicket issues proxy tickets
+//   for back-end services. With `Extra["AcceptProxyTickets"]` the tickets are validated at `proxyValidate`, so that
+//   this app can be called by other proxies; their proxy chain must be one of `Extra["AllowedProxyChains"]`,
+//   any proxy ticket is rejected when none is configured.
+// ref: https://apereo.github.io/cas/7.0.x/protocol/CAS-Protocol-Specification.html
+
+type CASProvider struct {
+	Name               string
+	serverURL          string
+	redirectURL        string
+	version            string
+	proxyCallbackURL   string
+	acceptProxyTickets bool
+	allowedProxyChains [][]string
+	proxyTickets       credential.Store
+	emailAttribute     string
+	nameAttribute      string
+}
+
+// CASUser is the validated user of a CAS ticket, the RawData of the CAS UserInfo
+type CASUser struct {
+	User       string              `json:"user"`
+	Attributes map[string][]string `json:"attributes"`
+	// Proxies is the proxy chain of a proxy ticket, the last proxy first
+	Proxies []string `json:"proxies,omitempty"`
+}
+
+// NewCASProvider creates a new CAS Provider instance
+//
+// Extra fields: `ServerURL` (the CAS server prefix, e.g. https://cas.example.org/cas), `Version` (`3` or `2`),
+// `ProxyCallbackURL`, `ProxyTicketStore`, `AcceptProxyTickets`, `AllowedProxyChains` (each chain lists the proxy callback
+// URLs separated by spaces, the last proxy first as returned by CAS), `EmailAttribute` (`mail` by default)
+// and `NameAttribute` (`displayName` by default).
+func NewCASProvider(cfg *types.OauthConfig) types.Provider {
+	proxyTickets, _ := cfg.Extra["ProxyTicketStore"].(credential.Store)
+	if proxyTickets == nil {
+		proxyTickets = credential.NewMemoryStore()
+	}
+
+	emailAttribute := extraString(cfg, "EmailAttribute")
+	if emailAttribute == "" {
+		emailAttribute = "mail"
+	}
+	nameAttribute := extraString(cfg, "NameAttribute")
+	if nameAttribute == "" {
+		nameAttribute = "displayName"
+	}
+
+	var allowedProxyChains [][]string
+	for _, chain := range extraStrings(cfg, "AllowedProxyChains") {
+		if proxies := strings.Fields(chain); len(proxies) > 0 {
+			allowedProxyChains = append(allowedProxyChains, proxies)
+		}
+	}
+
+	return &CASProvider{
+		Name:               types.CAS,
+		serverURL:          strings.TrimSuffix(extraString(cfg, "ServerURL"), "/"),
+		redirectURL:        cfg.RedirectURL,
+		version:            extraString(cfg, "Version"),
+		proxyCallbackURL:   extraString(cfg, "ProxyCallbackURL"),
+		acceptProxyTickets: extraBool(cfg, "AcceptProxyTickets"),
+		allowedProxyChains: allowedProxyChains,
+		proxyTickets:       proxyTickets,
+		emailAttribute:     emailAttribute,
+		nameAttribute:      nameAttribute,
+	}
+}
+
+func (p *CASProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	service, err := p.service(state)
+	if err != nil {
+		return ""
+	}
+	return p.serverURL + "/login?" + url.Values{"service": {service}}.Encode()
+}
+
+// service returns the service URL, the RedirectURL with the state (if any) added to its query
+func (p *CASProvider) service(state string) (string, error) {
+	service, err := url.Parse(p.redirectURL)
+	if err != nil {
+		return "", err
+	}
+	if state != "" {
+		query := service.Query()
+		query.Set("state", state)
+		service.RawQuery = query.Encode()
+	}
+	return service.String(), nil
+}
+
+// ExchangeCodeForToken validates the service ticket, code is the raw query string of the callback request
+// (or the bare ticket when GetAuthURL was called without state)
+func (p *CASProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	ticket, state := code, ""
+	if params, err := url.ParseQuery(code); err == nil && params.Get("ticket") != "" {
+		ticket, state = params.Get("ticket"), params.Get("state")
+	}
+	if ticket == "" {
+		return nil, fmt.Errorf("cas error: ticket is missing")
+	}
+
+	service, err := p.service(state)
+	if err != nil {
+		return nil, err
+	}
+
+	validatePath := "serviceValidate"
+	if p.acceptProxyTickets {
+		validatePath = "proxyValidate"
+	}
+	if p.version != "2" {
+		validatePath = "p3/" + validatePath
+	}
+
+	query := url.Values{
+		"service": {service},
+		"ticket":  {ticket},
+	}
+	if p.proxyCallbackURL != "" {
+		query.Set("pgtUrl", p.proxyCallbackURL)
+	}
+
+	var response casServiceResponse
+	if err := p.get(ctx, p.serverURL+"/"+validatePath+"?"+query.Encode(), &response); err != nil {
+		return nil, err
+	}
+	if failure := response.Failure; failure != nil {
+		return nil, fmt.Errorf("cas error: %s %s", failure.Code, strings.TrimSpace(failure.Message))
+	}
+	success := response.Success
+	if success == nil || strings.TrimSpace(success.User) == "" {
+		return nil, fmt.Errorf("cas error: unexpected validation response")
+	}
+
+	proxies := make([]string, 0, len(success.Proxies))
+	for _, proxy := range success.Proxies {
+		proxies = append(proxies, strings.TrimSpace(proxy))
+	}
+	// A proxy ticket is only accepted from the proxy chains trusted by this service
+	if len(proxies) > 0 && !p.proxyChainAllowed(proxies) {
+		return nil, fmt.Errorf("cas error: proxy chain %s is not allowed", strings.Join(proxies, " "))
+	}
+
+	casUser := &CASUser{
+		User:       strings.TrimSpace(success.User),
+		Attributes: make(map[string][]string),
+		Proxies:    proxies,
+	}
+	for _, attribute := range success.Attributes.Values {
+		name := attribute.XMLName.Local
+		casUser.Attributes[name] = append(casUser.Attributes[name], strings.TrimSpace(attribute.Value))
+	}
+
+	extra := map[string]interface{}{
+		"cas_user": casUser,
+	}
+	if iou := strings.TrimSpace(success.ProxyGrantingTicket); iou != "" {
+		// The CAS server delivers the proxy-granting ticket to the callback before answering the validation
+		pgt, err := p.proxyTickets.Get(ctx, casProxyKey(iou))
+		if err != nil {
+			return nil, err
+		}
+		if pgt == nil {
+			return nil, fmt.Errorf("cas error: proxy-granting ticket of %s was not delivered to the proxy callback", iou)
+		}
+		p.proxyTickets.Delete(ctx, casProxyKey(iou))
+		extra["pgt"] = pgt.Value
+	}
+
+	// The service ticket identifies the CAS session in single logout requests
+	token := &oauth2.Token{AccessToken: ticket}
+	return token.WithExtra(extra), nil
+}
+
+// proxyChainAllowed reports whether proxies is one of the allowed proxy chains
+func (p *CASProvider) proxyChainAllowed(proxies []string) bool {
+	return slices.ContainsFunc(p.allowedProxyChains, func(chain []string) bool {
+		return slices.Equal(chain, proxies)
+	})
+}
+
+func (p *CASProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	casUser, ok := token.Extra("cas_user").(*CASUser)
+	if !ok || casUser == nil {
+		return nil, fmt.Errorf("cas user not found in token")
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: casUser.User,
+		Email:          casUser.Attribute(p.emailAttribute),
+		Name:           casUser.Attribute(p.nameAttribute),
+		RawData:        casUser,
+	}, nil
+}
+
+// Attribute returns the first value of the attribute name, or ""
+func (u *CASUser) Attribute(name string) string {
+	if values := u.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// HandleProxyCallback is the http.Handler of `Extra["ProxyCallbackURL"]`, where the CAS server delivers
+// the proxy-granting tickets (`pgtId`) along with their IOU (`pgtIou`) before answering the ticket validation
+func (p *CASProvider) HandleProxyCallback(w http.ResponseWriter, r *http.Request) {
+	pgtIou, pgtID := r.URL.Query().Get("pgtIou"), r.URL.Query().Get("pgtId")
+	if pgtIou != "" && pgtID != "" {
+		// The IOU is claimed by the validation right after, it does not need to live long
+		err := p.proxyTickets.Set(r.Context(), casProxyKey(pgtIou), &credential.Token{
+			Value:     pgtID,
+			ExpiresAt: time.Now().Add(5 * time.Minute),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	// The CAS server also checks the callback with a request without params, it only expects a 200
+	w.WriteHeader(http.StatusOK)
+}
+
+// ProxyTicket issues a proxy ticket for targetService with the proxy-granting ticket of token
+func (p *CASProvider) ProxyTicket(ctx context.Context, token *oauth2.Token, targetService string) (string, error) {
+	pgt, _ := token.Extra("pgt").(string)
+	if pgt == "" {
+		return "", fmt.Errorf("cas proxy-granting ticket not found in token")
+	}
+
+	query := url.Values{
+		"pgt":           {pgt},
+		"targetService": {targetService},
+	}
+	var response casServiceResponse
+	if err := p.get(ctx, p.serverURL+"/proxy?"+query.Encode(), &response); err != nil {
+		return "", err
+	}
+	if failure := response.ProxyFailure; failure != nil {
+		return "", fmt.Errorf("cas proxy error: %s %s", failure.Code, strings.TrimSpace(failure.Message))
+	}
+	if response.ProxySuccess == nil || strings.TrimSpace(response.ProxySuccess.ProxyTicket) == "" {
+		return "", fmt.Errorf("cas proxy error: unexpected response")
+	}
+	return strings.TrimSpace(response.ProxySuccess.ProxyTicket), nil
+}
+
+// get calls a CAS endpoint and decodes its XML response into out
+func (p *CASProvider) get(ctx context.Context, endpoint string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cas error: %s", resp.Status)
+	}
+
+	if err := xml.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("cas error: invalid XML response: %w", err)
+	}
+	return nil
+}
+
+func casProxyKey(pgtIou string) string {
+	return "cas:pgtiou:" + pgtIou
+}
+
+// casServiceResponse is the `cas:serviceResponse` of the validation and proxy endpoints
+type casServiceResponse struct {
+	XMLName xml.Name `xml:"serviceResponse"`
+	Success *struct {
+		User                string   `xml:"user"`
+		ProxyGrantingTicket string   `xml:"proxyGrantingTicket"`
+		Proxies             []string `xml:"proxies>proxy"`
+		Attributes          struct {
+			Values []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"attributes"`
+	} `xml:"authenticationSuccess"`
+	Failure      *casFailure `xml:"authenticationFailure"`
+	ProxySuccess *struct {
+		ProxyTicket string `xml:"proxyTicket"`
+	} `xml:"proxySuccess"`
+	ProxyFailure *casFailure `xml:"proxyFailure"`
+}
+
+type casFailure struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// ParseCASLogoutRequest parses a CAS single logout request, posted by the CAS server to the service URL
+// with a `logoutRequest` form param, and returns the service ticket of the session to log out
+func ParseCASLogoutRequest(r *http.Request) (string, error) {
+	if r.Method != http.MethodPost {
+		return "", fmt.Errorf("cas error: logout requests are posted")
+	}
+	logoutRequest := r.PostFormValue("logoutRequest")
+	if logoutRequest == "" {
+		return "", fmt.Errorf("cas error: logoutRequest is missing")
+	}
+
+	var request struct {
+		XMLName      xml.Name `xml:"LogoutRequest"`
+		ID           string   `xml:"ID,attr"`
+		NameID       string   `xml:"NameID"`
+		SessionIndex string   `xml:"SessionIndex"`
+	}
+	if err := xml.Unmarshal([]byte(logoutRequest), &request); err != nil {
+		return "", fmt.Errorf("cas error: invalid logoutRequest: %w", err)
+	}
+
+	sessionIndex := strings.TrimSpace(request.SessionIndex)
+	if sessionIndex == "" {
+		return "", fmt.Errorf("cas error: logoutRequest has no SessionIndex")
+	}
+	return sessionIndex, nil
+}
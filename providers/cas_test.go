@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+const casSuccessResponse = `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationSuccess>
+		<cas:user>alice</cas:user>
+		<cas:attributes>
+			<cas:mail>alice@example.org</cas:mail>
+			<cas:displayName>Alice</cas:displayName>
+			<cas:memberOf>admins</cas:memberOf>
+			<cas:memberOf>staff</cas:memberOf>
+		</cas:attributes>%s
+	</cas:authenticationSuccess>
+</cas:serviceResponse>`
+
+const casFailureResponse = `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationFailure code="INVALID_TICKET">Ticket ST-1 not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`
+
+// casServer is an httptest CAS server stand-in, answering every validation with response
+type casServer struct {
+	*httptest.Server
+	// response is the validation response, its %s is replaced by the extra success elements
+	response string
+	extra    string
+	// paths are the requested paths, queries the validation queries
+	paths   []string
+	queries []url.Values
+	// proxyCallback is called before answering the validation, as the CAS server delivers the PGT first
+	proxyCallback func(query url.Values)
+}
+
+func newCASServer(t *testing.T) *casServer {
+	s := &casServer{response: casSuccessResponse}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.paths = append(s.paths, r.URL.Path)
+		query := r.URL.Query()
+		if r.URL.Path == "/cas/proxy" {
+			if query.Get("pgt") != "PGT-1" || query.Get("targetService") != "https://backend.example.org" {
+				fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:proxyFailure code="INVALID_REQUEST">unexpected request</cas:proxyFailure>
+</cas:serviceResponse>`)
+				return
+			}
+			fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:proxySuccess><cas:proxyTicket>PT-1</cas:proxyTicket></cas:proxySuccess>
+</cas:serviceResponse>`)
+			return
+		}
+
+		s.queries = append(s.queries, query)
+		if s.proxyCallback != nil {
+			s.proxyCallback(query)
+		}
+		if strings.Contains(s.response, "%s") {
+			fmt.Fprintf(w, s.response, s.extra)
+			return
+		}
+		fmt.Fprint(w, s.response)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestCASProvider(server *casServer, extra map[string]any) *CASProvider {
+	cfg := &types.OauthConfig{
+		RedirectURL: "https://app.example.org/callback",
+		Extra:       map[string]any{"ServerURL": server.URL + "/cas/"},
+	}
+	for k, v := range extra {
+		cfg.Extra[k] = v
+	}
+	return NewCASProvider(cfg).(*CASProvider)
+}
+
+func TestCASAuthURL(t *testing.T) {
+	server := newCASServer(t)
+	p := newTestCASProvider(server, nil)
+
+	authURL, err := url.Parse(p.GetAuthURL(context.Background(), "xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authURL.Path != "/cas/login" || authURL.Query().Get("service") != "https://app.example.org/callback?state=xyz" {
+		t.Fatalf("unexpected auth URL %s", authURL)
+	}
+}
+
+func TestCASValidateCAS3Attributes(t *testing.T) {
+	server := newCASServer(t)
+	p := newTestCASProvider(server, nil)
+	ctx := context.Background()
+
+	token, err := p.ExchangeCodeForToken(ctx, "ticket=ST-1&state=xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.paths[0] != "/cas/p3/serviceValidate" {
+		t.Fatalf("validated at %s, want /cas/p3/serviceValidate", server.paths[0])
+	}
+	query := server.queries[0]
+	if query.Get("ticket") != "ST-1" || query.Get("service") != "https://app.example.org/callback?state=xyz" || query.Has("pgtUrl") {
+		t.Fatalf("unexpected validation query %v", query)
+	}
+	if token.AccessToken != "ST-1" {
+		t.Fatalf("AccessToken = %q, want the service ticket", token.AccessToken)
+	}
+
+	userInfo, err := p.GetUserInfo(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.ProviderUserID != "alice" || userInfo.Email != "alice@example.org" || userInfo.Name != "Alice" {
+		t.Fatalf("unexpected user info %+v", userInfo)
+	}
+	casUser := userInfo.RawData.(*CASUser)
+	if groups := casUser.Attributes["memberOf"]; len(groups) != 2 || groups[0] != "admins" || groups[1] != "staff" {
+		t.Fatalf("memberOf = %v, want [admins staff]", groups)
+	}
+}
+
+func TestCASValidateFailure(t *testing.T) {
+	server := newCASServer(t)
+	server.response = casFailureResponse
+	p := newTestCASProvider(server, nil)
+
+	_, err := p.ExchangeCodeForToken(context.Background(), "ST-1")
+	if err == nil || !strings.Contains(err.Error(), "INVALID_TICKET") {
+		t.Fatalf("err = %v, want INVALID_TICKET", err)
+	}
+}
+
+func TestCASValidateVersion2(t *testing.T) {
+	server := newCASServer(t)
+	p := newTestCASProvider(server, map[string]any{"Version": "2"})
+
+	// A bare ticket is validated for the service without state
+	if _, err := p.ExchangeCodeForToken(context.Background(), "ST-1"); err != nil {
+		t.Fatal(err)
+	}
+	if server.paths[0] != "/cas/serviceValidate" {
+		t.Fatalf("validated at %s, want /cas/serviceValidate", server.paths[0])
+	}
+	if service := server.queries[0].Get("service"); service != "https://app.example.org/callback" {
+		t.Fatalf("service = %s", service)
+	}
+}
+
+func TestCASProxyValidate(t *testing.T) {
+	const chain = `
+		<cas:proxies>
+			<cas:proxy>https://proxy2.example.org/pgtCallback</cas:proxy>
+			<cas:proxy>https://proxy1.example.org/pgtCallback</cas:proxy>
+		</cas:proxies>`
+
+	tests := []struct {
+		name    string
+		allowed any
+		extra   string
+		wantErr bool
+	}{
+		{name: "service ticket", extra: ""},
+		{name: "no allowed chain", extra: chain, wantErr: true},
+		{name: "other chain", allowed: []string{"https://proxy1.example.org/pgtCallback"}, extra: chain, wantErr: true},
+		{name: "allowed chain", allowed: "https://other.example.org/cb, https://proxy2.example.org/pgtCallback https://proxy1.example.org/pgtCallback", extra: chain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newCASServer(t)
+			server.extra = tt.extra
+			extra := map[string]any{"AcceptProxyTickets": true}
+			if tt.allowed != nil {
+				extra["AllowedProxyChains"] = tt.allowed
+			}
+			p := newTestCASProvider(server, extra)
+
+			token, err := p.ExchangeCodeForToken(context.Background(), "PT-1")
+			if server.paths[0] != "/cas/p3/proxyValidate" {
+				t.Fatalf("validated at %s, want /cas/p3/proxyValidate", server.paths[0])
+			}
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "proxy chain") {
+					t.Fatalf("err = %v, want a rejected proxy chain", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			casUser := token.Extra("cas_user").(*CASUser)
+			if tt.extra != "" && (len(casUser.Proxies) != 2 || casUser.Proxies[0] != "https://proxy2.example.org/pgtCallback") {
+				t.Fatalf("Proxies = %v", casUser.Proxies)
+			}
+		})
+	}
+}
+
+func TestCASProxyGrantingTicket(t *testing.T) {
+	server := newCASServer(t)
+	server.extra = `
+		<cas:proxyGrantingTicket>PGTIOU-1</cas:proxyGrantingTicket>`
+	p := newTestCASProvider(server, map[string]any{"ProxyCallbackURL": "https://app.example.org/pgtCallback"})
+	ctx := context.Background()
+
+	// Without the delivery of the PGT to the callback, the IOU can't be claimed
+	if _, err := p.ExchangeCodeForToken(ctx, "ST-1"); err == nil {
+		t.Fatal("ExchangeCodeForToken succeeded without the proxy-granting ticket")
+	}
+
+	server.proxyCallback = func(query url.Values) {
+		if query.Get("pgtUrl") != "https://app.example.org/pgtCallback" {
+			t.Errorf("pgtUrl = %q", query.Get("pgtUrl"))
+		}
+		// The CAS server checks the callback without params, then delivers the PGT
+		for _, target := range []string{"/pgtCallback", "/pgtCallback?pgtIou=PGTIOU-1&pgtId=PGT-1"} {
+			recorder := httptest.NewRecorder()
+			p.HandleProxyCallback(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("proxy callback %s answered %d", target, recorder.Code)
+			}
+		}
+	}
+	token, err := p.ExchangeCodeForToken(ctx, "ST-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgt, _ := token.Extra("pgt").(string); pgt != "PGT-1" {
+		t.Fatalf("pgt = %q, want PGT-1", pgt)
+	}
+	// The IOU is claimed once
+	if stored, _ := p.proxyTickets.Get(ctx, casProxyKey("PGTIOU-1")); stored != nil {
+		t.Fatalf("the IOU is still stored: %+v", stored)
+	}
+
+	proxyTicket, err := p.ProxyTicket(ctx, token, "https://backend.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyTicket != "PT-1" {
+		t.Fatalf("proxy ticket = %q, want PT-1", proxyTicket)
+	}
+	if _, err := p.ProxyTicket(ctx, token, "https://other.example.org"); err == nil || !strings.Contains(err.Error(), "INVALID_REQUEST") {
+		t.Fatalf("err = %v, want INVALID_REQUEST", err)
+	}
+}
+
+func TestParseCASLogoutRequest(t *testing.T) {
+	logoutRequest := `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="LR-1" Version="2.0" IssueInstant="2024-01-01T00:00:00Z">
+	<saml:NameID>@NOT_USED@</saml:NameID>
+	<samlp:SessionIndex>ST-1</samlp:SessionIndex>
+</samlp:LogoutRequest>`
+
+	form := url.Values{"logoutRequest": {logoutRequest}}
+	r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	sessionIndex, err := ParseCASLogoutRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionIndex != "ST-1" {
+		t.Fatalf("session index = %q, want ST-1", sessionIndex)
+	}
+
+	if _, err := ParseCASLogoutRequest(httptest.NewRequest(http.MethodGet, "/callback?logoutRequest=x", nil)); err == nil {
+		t.Fatal("a logout request by GET was accepted")
+	}
+}
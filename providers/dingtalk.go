@@ -10,21 +10,115 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"time"
 
 	"golang.org/x/oauth2"
 
+	"go.xiexianbin.cn/authkit/credential"
 	"go.xiexianbin.cn/authkit/types"
 )
 
+// dingtalkError is an error response of DingTalk APIs, either `{code, message}` (v1.0 APIs) or `{errcode, errmsg}` (topapi)
+type dingtalkError struct {
+	Code    string
+	Message string
+}
+
+func (e *dingtalkError) Error() string {
+	return fmt.Sprintf("dingtalk error: %s %s", e.Code, e.Message)
+}
+
+// Unwrap reports the invalid or expired access token errors as credential.ErrExpired
+func (e *dingtalkError) Unwrap() error {
+	switch e.Code {
+	case "InvalidAuthentication", "40014", "42001":
+		return credential.ErrExpired
+	}
+	return nil
+}
+
+// DingTalk users sign in with their personal account, optionally on behalf of one of their organizations.
+//
+// **Key points**:
+// * The `corpid` scope lets the user pick an organization, its `corpId` is returned along with the user token
+//   and surfaced as `UserInfo.TenantID`; `Extra["CorpIDs"]` restricts the login to some organizations.
+// * The enterprise user record (userid, departments, title, job number) is only available through the
+//   server APIs of an internal app of that organization, called with the app accessToken (`Extra["FetchOrgUser"]`).
+// * H5 micro apps opened inside the DingTalk client get a login-free code from `dd.runtime.permission.requestAuthCode`
+//   instead of a redirect: with `Extra["Mode"] = "client_code"` it is exchanged by `topapi/v2/user/getuserinfo` with the
+//   app accessToken, and the profile comes from the enterprise user record. getuserinfo does not return the corpId,
+//   the organization of the internal app must be configured as the single entry of `CorpIDs`, it is surfaced as `UserInfo.TenantID`.
+//   Codes of `dd.requestAuthCode` are regular OAuth codes and work in the default mode.
+
+const (
+	// DingtalkModeWeb is the browser redirect login
+	DingtalkModeWeb = "web"
+	// DingtalkModeClientCode exchanges the login-free codes of internal H5 apps opened inside the DingTalk client
+	DingtalkModeClientCode = "client_code"
+)
+
 type DingtalkProvider struct {
-	Name   string
-	config *oauth2.Config
+	Name         string
+	config       *oauth2.Config
+	mode         string
+	credentials  *credential.Manager
+	subjectKind  string
+	corpIDs      []string
+	fetchOrgUser bool
 }
 
+// DingtalkUser is the RawData of the DingTalk UserInfo
+type DingtalkUser struct {
+	Nick      string `json:"nick"`
+	Avatar    string `json:"avatarUrl"`
+	Email     string `json:"email"`
+	OpenId    string `json:"openId"`
+	UnionId   string `json:"unionId"`
+	Mobile    string `json:"mobile"`
+	StateCode string `json:"stateCode"`
+	CorpID    string `json:"corpId,omitempty"`
+	// OrgUser is the enterprise user record, only set with `Extra["FetchOrgUser"]`
+	OrgUser *DingtalkOrgUser `json:"orgUser,omitempty"`
+}
+
+// DingtalkOrgUser is the enterprise user record of a DingTalk organization member
+type DingtalkOrgUser struct {
+	UserID     string  `json:"userid"`
+	UnionID    string  `json:"unionid"`
+	Name       string  `json:"name"`
+	Avatar     string  `json:"avatar"`
+	Mobile     string  `json:"mobile"`
+	DeptIDList []int64 `json:"dept_id_list"`
+	Title      string  `json:"title"`
+	JobNumber  string  `json:"job_number"`
+	Email      string  `json:"email"`
+	OrgEmail   string  `json:"org_email"`
+	Admin      bool    `json:"admin"`
+	Active     bool    `json:"active"`
+}
+
+// NewDingtalkProvider creates a new DingTalk Provider instance
+//
+// Extra fields: `Mode` (`web` or `client_code`), `CredentialManager` (caches the app accessToken),
+// `SubjectID` (`openid`, `unionid` or `user_id`, the latter is only unique within an organization and returned as `<corpId>:<userid>`),
+// `CorpIDs` (the organizations allowed to sign in, required in `client_code` mode with the single organization of the internal app)
+// and `FetchOrgUser` (fetch the enterprise user record with the app credentials, the app must be an internal app of the user organization).
 func NewDingtalkProvider(cfg *types.OauthConfig) types.Provider {
+	mode := extraString(cfg, "Mode")
+	if mode != DingtalkModeClientCode {
+		mode = DingtalkModeWeb
+	}
+
 	return &DingtalkProvider{
-		Name: types.DINGTALK,
+		Name:         types.DINGTALK,
+		mode:         mode,
+		credentials:  credentialManager(cfg),
+		subjectKind:  extraString(cfg, "SubjectID"),
+		corpIDs:      extraStrings(cfg, "CorpIDs"),
+		fetchOrgUser: extraBool(cfg, "FetchOrgUser"),
 		config: &oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
@@ -38,11 +132,19 @@ func NewDingtalkProvider(cfg *types.OauthConfig) types.Provider {
 	}
 }
 
+// GetAuthURL returns the redirect login URL, or "" in client_code mode where the code comes from the DingTalk JSAPI
 func (p *DingtalkProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	if p.mode == DingtalkModeClientCode {
+		return ""
+	}
 	return p.config.AuthCodeURL(state, opts...)
 }
 
 func (p *DingtalkProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if p.mode == DingtalkModeClientCode {
+		return p.exchangeClientCode(ctx, code)
+	}
+
 	// DingTalk requires POST request with JSON body
 	reqBody := map[string]string{
 		"clientId":     p.config.ClientID,
@@ -87,16 +189,128 @@ func (p *DingtalkProvider) ExchangeCodeForToken(ctx context.Context, code string
 		return nil, fmt.Errorf("dingtalk token error: %s", string(body))
 	}
 
+	if err := p.checkCorpID(tokenData.CorpId); err != nil {
+		return nil, err
+	}
+
 	token := &oauth2.Token{
 		AccessToken:  tokenData.AccessToken,
 		RefreshToken: tokenData.RefreshToken,
 		Expiry:       time.Now().Add(time.Duration(tokenData.ExpireIn) * time.Second),
 	}
 
-	return token, nil
+	return token.WithExtra(map[string]interface{}{
+		"corpId": tokenData.CorpId,
+	}), nil
+}
+
+// checkCorpID checks corpID against the `CorpIDs` allowlist, if any
+func (p *DingtalkProvider) checkCorpID(corpID string) error {
+	if len(p.corpIDs) == 0 {
+		return nil
+	}
+	if corpID == "" {
+		return fmt.Errorf("dingtalk error: no organization selected, the corpid scope is required")
+	}
+	if !slices.Contains(p.corpIDs, corpID) {
+		return fmt.Errorf("dingtalk error: organization %s is not allowed", corpID)
+	}
+	return nil
+}
+
+// exchangeClientCode exchanges a login-free code of an internal H5 app for the member userid and unionid
+func (p *DingtalkProvider) exchangeClientCode(ctx context.Context, code string) (*oauth2.Token, error) {
+	// The internal app belongs to a single organization, the one of its app accessToken, which scopes the userid
+	if len(p.corpIDs) != 1 {
+		return nil, fmt.Errorf("dingtalk error: client_code mode requires a single CorpIDs entry, the corpId of the internal app organization")
+	}
+	corpID := p.corpIDs[0]
+
+	var identity struct {
+		UserID  string `json:"userid"`
+		UnionID string `json:"unionid"`
+		Name    string `json:"name"`
+	}
+	err := p.credentials.Do(ctx, p.credentialKey(), p.fetchAppAccessToken, func(accessToken string) error {
+		return p.topapi(ctx, "topapi/v2/user/getuserinfo", accessToken, map[string]string{"code": code}, &identity)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if identity.UserID == "" {
+		return nil, fmt.Errorf("dingtalk error: userid not returned")
+	}
+
+	// There is no user access token for login-free codes, the user is identified by its userid
+	token := &oauth2.Token{}
+	return token.WithExtra(map[string]interface{}{
+		"userid":  identity.UserID,
+		"unionid": identity.UnionID,
+		"corpId":  corpID,
+	}), nil
+}
+
+// AppAccessToken returns the cached app accessToken, it can be used to call DingTalk server APIs
+func (p *DingtalkProvider) AppAccessToken(ctx context.Context) (string, error) {
+	return p.credentials.Get(ctx, p.credentialKey(), p.fetchAppAccessToken)
+}
+
+func (p *DingtalkProvider) credentialKey() string {
+	return "dingtalk:access_token:" + p.config.ClientID
+}
+
+// fetchAppAccessToken issues a new app accessToken from the appKey and appSecret
+func (p *DingtalkProvider) fetchAppAccessToken(ctx context.Context) (*credential.Token, error) {
+	reqBody := map[string]string{
+		"appKey":    p.config.ClientID,
+		"appSecret": p.config.ClientSecret,
+	}
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.dingtalk.com/v1.0/oauth2/accessToken", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenData struct {
+		AccessToken string `json:"accessToken"`
+		ExpireIn    int    `json:"expireIn"`
+		Code        string `json:"code"`
+		Message     string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &tokenData); err != nil {
+		return nil, err
+	}
+	if tokenData.AccessToken == "" {
+		return nil, &dingtalkError{Code: tokenData.Code, Message: tokenData.Message}
+	}
+
+	return &credential.Token{
+		Value:     tokenData.AccessToken,
+		ExpiresAt: time.Now().Add(time.Duration(tokenData.ExpireIn) * time.Second),
+	}, nil
 }
 
 func (p *DingtalkProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	if p.mode == DingtalkModeClientCode {
+		return p.getClientCodeUserInfo(ctx, token)
+	}
+
 	userInfoURL := "https://api.dingtalk.com/v1.0/contact/users/me"
 	req, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
 	if err != nil {
@@ -115,43 +329,192 @@ func (p *DingtalkProvider) GetUserInfo(ctx context.Context, token *oauth2.Token)
 		return nil, err
 	}
 
-	var userResp struct {
-		Nick      string `json:"nick"`
-		Avatar    string `json:"avatarUrl"`
-		Email     string `json:"email"`
-		OpenId    string `json:"openId"`
-		UnionId   string `json:"unionId"`
-		Mobile    string `json:"mobile"`
-		StateCode string `json:"stateCode"`
-	}
+	// The response is a flat JSON object: { "nick": "...", "avatarUrl": "...", "openId": "...", "unionId": "...", ... }
+	// ref: https://open.dingtalk.com/document/orgapp/dingtalk-get-user-info
 
+	var userResp DingtalkUser
 	if err := json.Unmarshal(body, &userResp); err != nil {
+		return nil, fmt.Errorf("dingtalk error: %s", string(body))
+	}
+	if userResp.UnionId == "" && userResp.OpenId == "" {
+		var errResp struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &errResp); err != nil || errResp.Code == "" {
+			return nil, fmt.Errorf("dingtalk error: %s", string(body))
+		}
+		return nil, &dingtalkError{Code: errResp.Code, Message: errResp.Message}
+	}
+
+	userResp.CorpID, _ = token.Extra("corpId").(string)
+	if err := p.checkCorpID(userResp.CorpID); err != nil {
+		return nil, err
+	}
+
+	userID := ""
+	if p.fetchOrgUser {
+		orgUser, err := p.OrgUser(ctx, userResp.UnionId)
+		if err != nil {
+			return nil, err
+		}
+		userResp.OrgUser = orgUser
+		userID = orgUser.UserID
+	}
+
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  userResp.OpenId,
+		types.SubjectUnionID: userResp.UnionId,
+		types.SubjectUserID:  tenantScopedID(userResp.CorpID, userID),
+	})
+	providerUserID, err := selectSubject("dingtalk", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
 		return nil, err
 	}
 
-	// DingTalk API returns strict structure, we might need to handle wrapper if present
-	// However, v1.0 usually returns data directly or inside "result" wrapper?
-	// Checking docs, it seems it might be direct fields or wrapped.
-	// Let's assume direct mapping for now based on common v1.0 APIs,
-	// but mostly DingTalk APIs wrap response in specific way.
-	// It usually returns a structure like request-id etc.
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		TenantID:       userResp.CorpID,
+		Name:           userResp.Nick,
+		AvatarURL:      userResp.Avatar,
+		Email:          userResp.Email,
+		RawData:        userResp,
+	}, nil
+}
+
+// getClientCodeUserInfo builds the UserInfo of a client_code login from the enterprise user record
+func (p *DingtalkProvider) getClientCodeUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	userID, ok := token.Extra("userid").(string)
+	if !ok || userID == "" {
+		return nil, fmt.Errorf("userid not found in token")
+	}
+
+	orgUser, err := p.OrgUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
 
-	// Re-checking docs: https://open.dingtalk.com/document/orgapp/dingtalk-get-user-info
-	// Response: { "nick": "...", "avatarUrl": "...", "openId": "...", "unionId": "...", ... }
-	// It seems it is a flat JSON structure for the user info part?
-	// ACTUALLY, usually DingTalk new API responses are simple JSON.
+	unionID := orgUser.UnionID
+	if unionID == "" {
+		unionID, _ = token.Extra("unionid").(string)
+	}
+	email := orgUser.Email
+	if email == "" {
+		email = orgUser.OrgEmail
+	}
+	corpID, _ := token.Extra("corpId").(string)
+	if err := p.checkCorpID(corpID); err != nil {
+		return nil, err
+	}
+	userResp := DingtalkUser{
+		Nick:    orgUser.Name,
+		Avatar:  orgUser.Avatar,
+		Email:   email,
+		UnionId: unionID,
+		Mobile:  orgUser.Mobile,
+		CorpID:  corpID,
+		OrgUser: orgUser,
+	}
 
-	providerUserID := userResp.UnionId
-	if providerUserID == "" {
-		providerUserID = userResp.OpenId
+	// There is no openId for login-free codes
+	ids := compactIDs(map[string]string{
+		types.SubjectUnionID: unionID,
+		types.SubjectUserID:  tenantScopedID(corpID, orgUser.UserID),
+	})
+	providerUserID, err := selectSubject("dingtalk", p.subjectKind, ids, types.SubjectUnionID, types.SubjectUserID)
+	if err != nil {
+		return nil, err
 	}
 
 	return &types.UserInfo{
 		Provider:       p.Name,
 		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		TenantID:       userResp.CorpID,
 		Name:           userResp.Nick,
 		AvatarURL:      userResp.Avatar,
 		Email:          userResp.Email,
+		Phone:          userResp.Mobile,
 		RawData:        userResp,
 	}, nil
 }
+
+// OrgUser returns the enterprise user record of the organization member with the given unionId,
+// using the app accessToken; the app must be an internal app of the user organization
+func (p *DingtalkProvider) OrgUser(ctx context.Context, unionID string) (*DingtalkOrgUser, error) {
+	if unionID == "" {
+		return nil, fmt.Errorf("dingtalk error: unionId is required to fetch the enterprise user")
+	}
+
+	var byUnionID struct {
+		UserID      string `json:"userid"`
+		ContactType int    `json:"contact_type"`
+	}
+	err := p.credentials.Do(ctx, p.credentialKey(), p.fetchAppAccessToken, func(accessToken string) error {
+		return p.topapi(ctx, "topapi/user/getbyunionid", accessToken, map[string]string{"unionid": unionID}, &byUnionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if byUnionID.UserID == "" {
+		return nil, fmt.Errorf("dingtalk error: user %s is not a member of the organization", unionID)
+	}
+
+	return p.OrgUserByID(ctx, byUnionID.UserID)
+}
+
+// OrgUserByID returns the enterprise user record of the organization member with the given userid
+func (p *DingtalkProvider) OrgUserByID(ctx context.Context, userID string) (*DingtalkOrgUser, error) {
+	var orgUser DingtalkOrgUser
+	err := p.credentials.Do(ctx, p.credentialKey(), p.fetchAppAccessToken, func(accessToken string) error {
+		return p.topapi(ctx, "topapi/v2/user/get", accessToken, map[string]string{
+			"userid":   userID,
+			"language": "zh_CN",
+		}, &orgUser)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &orgUser, nil
+}
+
+// topapi calls a legacy oapi.dingtalk.com server API and decodes its `result` into out
+func (p *DingtalkProvider) topapi(ctx context.Context, path, accessToken string, payload any, out any) error {
+	jsonBody, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	apiURL := "https://oapi.dingtalk.com/" + path + "?access_token=" + url.QueryEscape(accessToken)
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		ErrCode int             `json:"errcode"`
+		ErrMsg  string          `json:"errmsg"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	if result.ErrCode != 0 {
+		return &dingtalkError{Code: strconv.Itoa(result.ErrCode), Message: result.ErrMsg}
+	}
+	return json.Unmarshal(result.Result, out)
+}
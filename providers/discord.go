@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Discord follows OAuth 2.0, the user is read from `/users/@me`.
+//
+// **Key points**:
+// * The avatar is a hash, the URL is built on the CDN (animated avatars start with `a_`),
+//   users without an avatar get one of the default avatars.
+// * `Extra["GuildIDs"]` restricts the login to the members of some guilds (servers),
+//   the `guilds` scope is then requested and checked with `/users/@me/guilds`.
+// * An email which is not `verified` is not put in the UserInfo.
+
+const discordAPIURL = "https://discord.com/api/v10"
+
+type DiscordProvider struct {
+	Name     string
+	config   *oauth2.Config
+	guildIDs []string
+}
+
+// NewDiscordProvider creates a new Discord Provider instance
+//
+// Extra fields: `GuildIDs` (the guilds the user must be a member of, any of them).
+func NewDiscordProvider(cfg *types.OauthConfig) types.Provider {
+	guildIDs := extraStrings(cfg, "GuildIDs")
+	scopes := []string{"identify", "email"}
+	if len(guildIDs) > 0 {
+		scopes = append(scopes, "guilds")
+	}
+
+	return &DiscordProvider{
+		Name:     types.DISCORD,
+		guildIDs: guildIDs,
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://discord.com/oauth2/authorize",
+				TokenURL: discordAPIURL + "/oauth2/token",
+			},
+		},
+	}
+}
+
+func (p *DiscordProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *DiscordProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *DiscordProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	var discordUser struct {
+		ID            string `json:"id"`
+		Username      string `json:"username"`
+		GlobalName    string `json:"global_name"`
+		Discriminator string `json:"discriminator"`
+		Avatar        string `json:"avatar"`
+		Email         string `json:"email"`
+		Verified      bool   `json:"verified"`
+	}
+	if err := p.get(ctx, token, "/users/@me", &discordUser); err != nil {
+		return nil, err
+	}
+	if discordUser.ID == "" {
+		return nil, fmt.Errorf("discord error: user id not returned")
+	}
+
+	if len(p.guildIDs) > 0 {
+		if err := p.checkGuilds(ctx, token); err != nil {
+			return nil, err
+		}
+	}
+
+	name := discordUser.GlobalName
+	if name == "" {
+		name = discordUser.Username
+	}
+	email := ""
+	if discordUser.Verified {
+		email = discordUser.Email
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: discordUser.ID,
+		Email:          email,
+		Name:           name,
+		AvatarURL:      discordAvatarURL(discordUser.ID, discordUser.Avatar, discordUser.Discriminator),
+		RawData:        discordUser,
+	}, nil
+}
+
+// checkGuilds checks that the user is a member of one of the configured guilds
+func (p *DiscordProvider) checkGuilds(ctx context.Context, token *oauth2.Token) error {
+	var guilds []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := p.get(ctx, token, "/users/@me/guilds", &guilds); err != nil {
+		return err
+	}
+	for _, guild := range guilds {
+		if slices.Contains(p.guildIDs, guild.ID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("discord user is not a member of the allowed guilds")
+}
+
+// get calls a Discord API with the user token and decodes the JSON response into out
+func (p *DiscordProvider) get(ctx context.Context, token *oauth2.Token, path string, out any) error {
+	client := p.config.Client(ctx, token)
+	resp, err := client.Get(discordAPIURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		var discordErr struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &discordErr)
+		return fmt.Errorf("discord error: %d %s", discordErr.Code, discordErr.Message)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// discordAvatarURL builds the CDN URL of an avatar hash, or of the default avatar when there is none
+// ref: https://discord.com/developers/docs/reference#image-formatting
+func discordAvatarURL(userID, avatar, discriminator string) string {
+	if avatar != "" {
+		ext := "png"
+		if strings.HasPrefix(avatar, "a_") {
+			ext = "gif"
+		}
+		return fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.%s", userID, avatar, ext)
+	}
+
+	// Users migrated to unique usernames have the "0" discriminator
+	index := uint64(0)
+	if discriminator == "" || discriminator == "0" {
+		id, _ := strconv.ParseUint(userID, 10, 64)
+		index = (id >> 22) % 6
+	} else {
+		d, _ := strconv.ParseUint(discriminator, 10, 64)
+		index = d % 5
+	}
+	return fmt.Sprintf("https://cdn.discordapp.com/embed/avatars/%d.png", index)
+}
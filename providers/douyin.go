@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Douyin Open Platform (open.douyin.com) follows OAuth 2.0 with its own naming.
+//
+// **Key points**:
+// * Douyin expects `client_key` instead of `client_id`, and comma separated scopes.
+// * The token response is wrapped in `{data, message}`, errors are `data.error_code` / `data.description`.
+// * The `open_id` (per app) and `union_id` (per developer account) are returned with the token,
+//   they are stored in the token Extra and needed to read the user info.
+
+type DouyinProvider struct {
+	Name        string
+	config      *oauth2.Config
+	subjectKind string
+}
+
+// NewDouyinProvider creates a new Douyin Provider instance
+//
+// Extra fields: `SubjectID` (`openid` or `unionid`).
+func NewDouyinProvider(cfg *types.OauthConfig) types.Provider {
+	return &DouyinProvider{
+		Name:        types.DOUYIN,
+		subjectKind: extraString(cfg, "SubjectID"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{"user_info"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://open.douyin.com/platform/oauth/connect/",
+				TokenURL: "https://open.douyin.com/oauth/access_token/",
+			},
+		},
+	}
+}
+
+func (p *DouyinProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	// Douyin expects client_key instead of client_id
+	return clientKeyAuthURL(p.config, state, opts...)
+}
+
+func (p *DouyinProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	values := url.Values{
+		"client_key":    {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+	}
+
+	var tokenData struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		RefreshExpiresIn int64  `json:"refresh_expires_in"`
+		OpenID           string `json:"open_id"`
+		UnionID          string `json:"union_id"`
+		Scope            string `json:"scope"`
+		douyinError
+	}
+	if err := p.postForm(ctx, p.config.Endpoint.TokenURL, values, &tokenData); err != nil {
+		return nil, err
+	}
+	if err := tokenData.err(); err != nil {
+		return nil, err
+	}
+	if tokenData.AccessToken == "" || tokenData.OpenID == "" {
+		return nil, fmt.Errorf("douyin error: access_token or open_id not returned")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}
+	// Store open_id/union_id/scope in Extra
+	return token.WithExtra(map[string]interface{}{
+		"open_id":  tokenData.OpenID,
+		"union_id": tokenData.UnionID,
+		"scope":    tokenData.Scope,
+	}), nil
+}
+
+func (p *DouyinProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	openID, ok := token.Extra("open_id").(string)
+	if !ok || openID == "" {
+		return nil, fmt.Errorf("open_id not found in token")
+	}
+
+	values := url.Values{
+		"access_token": {token.AccessToken},
+		"open_id":      {openID},
+	}
+
+	var douyinUser struct {
+		OpenID   string `json:"open_id"`
+		UnionID  string `json:"union_id"`
+		Nickname string `json:"nickname"`
+		Avatar   string `json:"avatar"`
+		douyinError
+	}
+	if err := p.postForm(ctx, "https://open.douyin.com/oauth/userinfo/", values, &douyinUser); err != nil {
+		return nil, err
+	}
+	if err := douyinUser.err(); err != nil {
+		return nil, err
+	}
+
+	unionID := douyinUser.UnionID
+	if unionID == "" {
+		unionID, _ = token.Extra("union_id").(string)
+	}
+
+	// Prioritize using union_id, unless the subject is configured
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  openID,
+		types.SubjectUnionID: unionID,
+	})
+	providerUserID, err := selectSubject("douyin", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		Name:           douyinUser.Nickname,
+		AvatarURL:      douyinUser.Avatar,
+		Email:          "", // Douyin does not provide email
+		RawData:        douyinUser,
+	}, nil
+}
+
+// postForm posts a form to a Douyin API and decodes the `data` of the response into out
+func (p *DouyinProvider) postForm(ctx context.Context, apiURL string, values url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Data    json.RawMessage `json:"data"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+	if len(envelope.Data) == 0 {
+		return fmt.Errorf("douyin error: %s", envelope.Message)
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+// douyinError is the error embedded in the `data` of Douyin responses
+type douyinError struct {
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+func (e douyinError) err() error {
+	if e.ErrorCode != 0 {
+		return fmt.Errorf("douyin error: %d %s", e.ErrorCode, e.Description)
+	}
+	return nil
+}
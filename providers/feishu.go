@@ -14,84 +14,164 @@ import (
 
 	"golang.org/x/oauth2"
 
+	"go.xiexianbin.cn/authkit/credential"
 	"go.xiexianbin.cn/authkit/types"
 )
 
+// Feishu (China) and Lark (global) share the same Open Platform APIs on different domains.
+//
+// **Key points**:
+// * `Extra["Region"]` selects `feishu` (open.feishu.cn, default) or `lark` (open.larksuite.com).
+// * `Extra["AuthAPI"]` selects the user access token API: `v2` (default, `authen/v2/oauth/token` with client_id/secret)
+//   or `v1` (`authen/v1/oidc/access_token` authorized by an `app_access_token`).
+// * Web apps opened inside the Feishu client get a code from `tt.requestAuthCode` instead of a redirect:
+//   with `Extra["Mode"] = "client_code"` it is exchanged by `authen/v1/access_token` with the app_access_token.
+// * Open Platform APIs answer with the `{code, msg, data}` envelope, `code` is 0 on success.
+// * `user_id` is only unique within a tenant, it is qualified as `<tenant_key>:<user_id>` (`UserInfo.TenantID` is the tenant_key).
+
+const (
+	// FeishuRegionFeishu is Feishu, served for tenants in mainland China
+	FeishuRegionFeishu = "feishu"
+	// FeishuRegionLark is Lark, served for tenants outside mainland China
+	FeishuRegionLark = "lark"
+
+	// FeishuAuthV1 uses the `authen/v1` user access token API
+	FeishuAuthV1 = "v1"
+	// FeishuAuthV2 uses the `authen/v2` OAuth token API
+	FeishuAuthV2 = "v2"
+
+	// FeishuModeWeb is the browser redirect login
+	FeishuModeWeb = "web"
+	// FeishuModeClientCode exchanges the `tt.requestAuthCode` codes of web apps opened inside the Feishu client
+	FeishuModeClientCode = "client_code"
+)
+
+// feishuError is a non-zero `code` of the Feishu response envelope
+type feishuError struct {
+	Code int
+	Msg  string
+}
+
+func (e *feishuError) Error() string {
+	return fmt.Sprintf("feishu error: %d %s", e.Code, e.Msg)
+}
+
+// Unwrap reports the invalid app/tenant access token errors as credential.ErrExpired
+func (e *feishuError) Unwrap() error {
+	switch e.Code {
+	case 20014, 99991663, 99991664:
+		return credential.ErrExpired
+	}
+	return nil
+}
+
 type FeishuProvider struct {
-	Name   string
-	config *oauth2.Config
+	Name        string
+	config      *oauth2.Config
+	baseURL     string
+	authAPI     string
+	mode        string
+	credentials *credential.Manager
+	subjectKind string
 }
 
+// NewFeishuProvider creates a new Feishu / Lark Provider instance
+//
+// Extra fields: `Region` (`feishu` or `lark`), `AuthAPI` (`v2` or `v1`), `Mode` (`web` or `client_code`), `CredentialManager` (caches the app_access_token)
+// and `SubjectID` (`openid`, `unionid` or `user_id`, the latter is only unique within a tenant and returned as `<tenant_key>:<user_id>`).
 func NewFeishuProvider(cfg *types.OauthConfig) types.Provider {
+	baseURL, accountsURL := "https://open.feishu.cn", "https://accounts.feishu.cn"
+	if extraString(cfg, "Region") == FeishuRegionLark {
+		baseURL, accountsURL = "https://open.larksuite.com", "https://accounts.larksuite.com"
+	}
+
+	authAPI := extraString(cfg, "AuthAPI")
+	if authAPI != FeishuAuthV1 {
+		authAPI = FeishuAuthV2
+	}
+
+	mode := extraString(cfg, "Mode")
+	if mode != FeishuModeClientCode {
+		mode = FeishuModeWeb
+	}
+
+	tokenURL := baseURL + "/open-apis/authen/v2/oauth/token"
+	switch {
+	case mode == FeishuModeClientCode:
+		tokenURL = baseURL + "/open-apis/authen/v1/access_token"
+	case authAPI == FeishuAuthV1:
+		tokenURL = baseURL + "/open-apis/authen/v1/oidc/access_token"
+	}
+
 	return &FeishuProvider{
-		Name: types.FEISHU,
+		Name:        types.FEISHU,
+		baseURL:     baseURL,
+		authAPI:     authAPI,
+		mode:        mode,
+		credentials: credentialManager(cfg),
+		subjectKind: extraString(cfg, "SubjectID"),
 		config: &oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
 			RedirectURL:  cfg.RedirectURL,
 			Scopes:       []string{}, // Feishu scopes are configured in the app console, usually not needed here or just empty
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://passport.feishu.cn/suite/passport/oauth/authorize",
-				TokenURL: "https://passport.feishu.cn/suite/passport/oauth/token",
+				AuthURL:  accountsURL + "/open-apis/authen/v1/authorize",
+				TokenURL: tokenURL,
 			},
 		},
 	}
 }
 
+// GetAuthURL returns the redirect login URL, or "" in client_code mode where the code comes from the Feishu JSAPI
 func (p *FeishuProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	if p.mode == FeishuModeClientCode {
+		return ""
+	}
+	if p.authAPI == FeishuAuthV1 {
+		// The v1 API identifies the app with app_id
+		opts = append(opts, oauth2.SetAuthURLParam("app_id", p.config.ClientID))
+	}
 	return p.config.AuthCodeURL(state, opts...)
 }
 
 func (p *FeishuProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
-	// Feishu might require app_access_token separately effectively?
-	// Or standard OAuth flow works?
-	// Docs say POST to https://passport.feishu.cn/suite/passport/oauth/token
-	// form-data or json? usually x-www-form-urlencoded compatible or json.
+	if p.mode == FeishuModeClientCode || p.authAPI == FeishuAuthV1 {
+		return p.exchangeCodeV1(ctx, code)
+	}
 
-	values := map[string]string{
+	reqBody := map[string]string{
 		"grant_type":    "authorization_code",
 		"client_id":     p.config.ClientID,
 		"client_secret": p.config.ClientSecret,
 		"code":          code,
 		"redirect_uri":  p.config.RedirectURL,
 	}
-
-	jsonBody, err := json.Marshal(values)
-	if err != nil {
-		return nil, err
+	if verifier := authCodeOptionValues(opts...).Get("code_verifier"); verifier != "" {
+		reqBody["code_verifier"] = verifier
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", p.config.Endpoint.TokenURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	body, err := p.doRequest(ctx, "POST", p.config.Endpoint.TokenURL, "", reqBody)
 	if err != nil {
 		return nil, err
 	}
 
+	// The v2 token API is flat instead of using the data envelope
 	var tokenResp struct {
+		Code             int    `json:"code"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
 		AccessToken      string `json:"access_token"`
 		RefreshToken     string `json:"refresh_token"`
 		TokenType        string `json:"token_type"`
 		ExpiresIn        int    `json:"expires_in"`
-		RefreshExpiresIn int    `json:"refresh_expires_in"`
+		Scope            string `json:"scope"`
 	}
-
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
 		return nil, err
 	}
-
-	if tokenResp.AccessToken == "" {
-		return nil, fmt.Errorf("feishu token error: %s", string(body))
+	if tokenResp.Code != 0 || tokenResp.AccessToken == "" {
+		return nil, fmt.Errorf("feishu token error: %d %s %s", tokenResp.Code, tokenResp.Error, tokenResp.ErrorDescription)
 	}
 
 	token := &oauth2.Token{
@@ -100,75 +180,205 @@ func (p *FeishuProvider) ExchangeCodeForToken(ctx context.Context, code string,
 		TokenType:    tokenResp.TokenType,
 		Expiry:       time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
 	}
-
-	return token, nil
+	return token.WithExtra(map[string]interface{}{
+		"scope": tokenResp.Scope,
+	}), nil
 }
 
-func (p *FeishuProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
-	userInfoURL := "https://passport.feishu.cn/suite/passport/oauth/userinfo"
-	req, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
+// exchangeCodeV1 exchanges the code with the `authen/v1` APIs, authorized by the app_access_token
+func (p *FeishuProvider) exchangeCodeV1(ctx context.Context, code string) (*oauth2.Token, error) {
+	reqBody := map[string]string{
+		"grant_type": "authorization_code",
+		"code":       code,
+	}
+
+	var tokenData struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		Scope        string `json:"scope"`
+	}
+	err := p.credentials.Do(ctx, p.credentialKey("app_access_token"), p.fetchAppAccessToken, func(appAccessToken string) error {
+		body, err := p.doRequest(ctx, "POST", p.config.Endpoint.TokenURL, appAccessToken, reqBody)
+		if err != nil {
+			return err
+		}
+		return decodeFeishuEnvelope(body, &tokenData)
+	})
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	token := &oauth2.Token{
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+		TokenType:    tokenData.TokenType,
+		Expiry:       time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}
+	return token.WithExtra(map[string]interface{}{
+		"scope": tokenData.Scope,
+	}), nil
+}
+
+// AppAccessToken returns the cached app_access_token, it can be used to call other Open Platform APIs
+func (p *FeishuProvider) AppAccessToken(ctx context.Context) (string, error) {
+	return p.credentials.Get(ctx, p.credentialKey("app_access_token"), p.fetchAppAccessToken)
+}
+
+// TenantAccessToken returns the cached tenant_access_token of a self-built app
+func (p *FeishuProvider) TenantAccessToken(ctx context.Context) (string, error) {
+	return p.credentials.Get(ctx, p.credentialKey("tenant_access_token"), p.fetchTenantAccessToken)
+}
+
+func (p *FeishuProvider) credentialKey(kind string) string {
+	return "feishu:" + kind + ":" + p.config.ClientID
+}
+
+func (p *FeishuProvider) fetchAppAccessToken(ctx context.Context) (*credential.Token, error) {
+	return p.fetchInternalToken(ctx, "app_access_token")
+}
+
+func (p *FeishuProvider) fetchTenantAccessToken(ctx context.Context) (*credential.Token, error) {
+	return p.fetchInternalToken(ctx, "tenant_access_token")
+}
+
+// fetchInternalToken issues a new app_access_token or tenant_access_token for a self-built app
+func (p *FeishuProvider) fetchInternalToken(ctx context.Context, kind string) (*credential.Token, error) {
+	reqBody := map[string]string{
+		"app_id":     p.config.ClientID,
+		"app_secret": p.config.ClientSecret,
+	}
+	body, err := p.doRequest(ctx, "POST", p.baseURL+"/open-apis/auth/v3/"+kind+"/internal", "", reqBody)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	// These APIs are flat as well, the token is named after its kind
+	var tokenResp struct {
+		Code              int    `json:"code"`
+		Msg               string `json:"msg"`
+		AppAccessToken    string `json:"app_access_token"`
+		TenantAccessToken string `json:"tenant_access_token"`
+		Expire            int    `json:"expire"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, err
+	}
+	if tokenResp.Code != 0 {
+		return nil, &feishuError{Code: tokenResp.Code, Msg: tokenResp.Msg}
+	}
+
+	value := tokenResp.AppAccessToken
+	if kind == "tenant_access_token" {
+		value = tokenResp.TenantAccessToken
+	}
+	return &credential.Token{
+		Value:     value,
+		ExpiresAt: time.Now().Add(time.Duration(tokenResp.Expire) * time.Second),
+	}, nil
+}
+
+func (p *FeishuProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	body, err := p.doRequest(ctx, "GET", p.baseURL+"/open-apis/authen/v1/user_info", token.AccessToken, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	var userResp struct {
-		Name         string `json:"name"`
-		EnName       string `json:"en_name"`
-		AvatarUrl    string `json:"avatar_url"`
-		AvatarThumb  string `json:"avatar_thumb"`
-		AvatarMiddle string `json:"avatar_middle"`
-		AvatarBig    string `json:"avatar_big"`
-		Email        string `json:"email"`
-		UserId       string `json:"user_id"`
-		Mobile       string `json:"mobile"`
-		UnionId      string `json:"union_id"`
-		OpenId       string `json:"open_id"`
-	}
-
-	// Docs say it returns a JSON object with user info.
-	if err := json.Unmarshal(body, &userResp); err != nil {
+		Name            string `json:"name"`
+		EnName          string `json:"en_name"`
+		AvatarUrl       string `json:"avatar_url"`
+		AvatarThumb     string `json:"avatar_thumb"`
+		AvatarMiddle    string `json:"avatar_middle"`
+		AvatarBig       string `json:"avatar_big"`
+		Email           string `json:"email"`
+		EnterpriseEmail string `json:"enterprise_email"`
+		UserId          string `json:"user_id"`
+		Mobile          string `json:"mobile"`
+		UnionId         string `json:"union_id"`
+		OpenId          string `json:"open_id"`
+		TenantKey       string `json:"tenant_key"`
+		EmployeeNo      string `json:"employee_no"`
+	}
+	if err := decodeFeishuEnvelope(body, &userResp); err != nil {
 		return nil, err
 	}
 
-	if userResp.OpenId == "" && userResp.UnionId == "" {
-		// Possibly wrapped in "data" or error?
-		// "code": 0, "msg": "success", "data": {...} ?
-		// Wait, some older docs say one thing, new docs say another.
-		// Trying to handle common wrapper if initial unmarshal fails to find ID.
-		var wrapper struct {
-			Code int             `json:"code"`
-			Msg  string          `json:"msg"`
-			Data json.RawMessage `json:"data"`
-		}
-		if err := json.Unmarshal(body, &wrapper); err == nil && wrapper.Code != 0 {
-			return nil, fmt.Errorf("feishu error: %s", wrapper.Msg)
-		}
+	// Prioritize UnionID, unless the subject is configured
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  userResp.OpenId,
+		types.SubjectUnionID: userResp.UnionId,
+		types.SubjectUserID:  tenantScopedID(userResp.TenantKey, userResp.UserId),
+	})
+	providerUserID, err := selectSubject("feishu", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Prioritize UnionID
-	providerUserID := userResp.UnionId
-	if providerUserID == "" {
-		providerUserID = userResp.OpenId
+	email := userResp.Email
+	if email == "" {
+		email = userResp.EnterpriseEmail
 	}
 
 	return &types.UserInfo{
 		Provider:       p.Name,
 		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		TenantID:       userResp.TenantKey,
 		Name:           userResp.Name,
 		AvatarURL:      userResp.AvatarUrl,
-		Email:          userResp.Email,
+		Email:          email,
 		RawData:        userResp,
 	}, nil
 }
+
+// doRequest calls a Feishu Open Platform API with an optional bearer token and JSON payload
+func (p *FeishuProvider) doRequest(ctx context.Context, method, apiURL, bearer string, payload any) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		jsonBody, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewBuffer(jsonBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// decodeFeishuEnvelope decodes the documented `{code, msg, data}` envelope into out
+func decodeFeishuEnvelope(body []byte, out any) error {
+	var envelope struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+	if envelope.Code != 0 {
+		return &feishuError{Code: envelope.Code, Msg: envelope.Msg}
+	}
+	if len(envelope.Data) == 0 {
+		return fmt.Errorf("feishu error: empty data in response")
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
@@ -44,6 +44,14 @@ func (p *GithubProvider) ExchangeCodeForToken(ctx context.Context, code string,
 	return p.config.Exchange(ctx, code, opts...)
 }
 
+func (p *GithubProvider) DeviceAuth(ctx context.Context, opts ...oauth2.AuthCodeOption) (*oauth2.DeviceAuthResponse, error) {
+	return p.config.DeviceAuth(ctx, opts...)
+}
+
+func (p *GithubProvider) DeviceAccessToken(ctx context.Context, da *oauth2.DeviceAuthResponse, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return deviceAccessToken(ctx, p.config, da, opts...)
+}
+
 func (p *GithubProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
 	client := p.config.Client(ctx, token)
 	resp, err := client.Get("https://api.github.com/user")
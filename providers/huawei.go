@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Huawei ID follows OAuth 2.0 and OpenID Connect on oauth-login.cloud.huawei.com.
+//
+// **Key points**:
+// * The `openid profile` scopes return an id_token, verified with the keys of `/oauth2/v3/certs`
+//   and the `https://accounts.huawei.com` issuer (which is not served as a discovery document).
+// * The openID (per app) and unionID (per developer account) come from the `GOpen.User.getInfo` API.
+// * The `email` scope requires a permission of the app in AppGallery Connect, it is only requested with `Extra["RequestEmail"]`;
+//   the email is only used when the id_token says `email_verified`.
+// * The id_token `sub` must match the getInfo openID.
+
+const (
+	huaweiIssuer  = "https://accounts.huawei.com"
+	huaweiCertURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/certs"
+)
+
+type HuaweiProvider struct {
+	Name        string
+	config      *oauth2.Config
+	subjectKind string
+}
+
+// NewHuaweiProvider creates a new Huawei ID Provider instance, the ClientID is the app ID
+//
+// Extra fields: `RequestEmail` (request the email scope) and `SubjectID` (`openid` or `unionid`).
+func NewHuaweiProvider(cfg *types.OauthConfig) types.Provider {
+	scopes := []string{oidc.ScopeOpenID, "profile"}
+	if extraBool(cfg, "RequestEmail") {
+		scopes = append(scopes, "email")
+	}
+
+	return &HuaweiProvider{
+		Name:        types.HUAWEI,
+		subjectKind: extraString(cfg, "SubjectID"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://oauth-login.cloud.huawei.com/oauth2/v3/authorize",
+				TokenURL:  "https://oauth-login.cloud.huawei.com/oauth2/v3/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+func (p *HuaweiProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *HuaweiProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *HuaweiProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	// The id_token is only returned by the code exchange, tokens restored from storage may not have it
+	var claims struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if idTokenStr, ok := token.Extra("id_token").(string); ok && idTokenStr != "" {
+		verifier := oidc.NewVerifier(huaweiIssuer, oidc.NewRemoteKeySet(ctx, huaweiCertURL), &oidc.Config{
+			ClientID: p.config.ClientID,
+		})
+		idToken, err := verifier.Verify(ctx, idTokenStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify huawei id_token: %w", err)
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal huawei id_token claims: %w", err)
+		}
+	}
+
+	values := url.Values{
+		"access_token": {token.AccessToken},
+		"getNickName":  {"1"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://account.cloud.huawei.com/rest.php?nsp_svc=GOpen.User.getInfo", strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var huaweiUser struct {
+		OpenID         string `json:"openID"`
+		UnionID        string `json:"unionID"`
+		DisplayName    string `json:"displayName"`
+		HeadPictureURL string `json:"headPictureURL"`
+		Email          string `json:"email"`
+		Error          string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &huaweiUser); err != nil {
+		return nil, err
+	}
+	// Errors are reported by the NSP_STATUS header, with an `error` message in the body
+	if status := resp.Header.Get("NSP_STATUS"); status != "" || huaweiUser.Error != "" {
+		return nil, fmt.Errorf("huawei error: %s %s", status, huaweiUser.Error)
+	}
+
+	if claims.Sub != "" && claims.Sub != huaweiUser.OpenID {
+		return nil, fmt.Errorf("huawei getInfo openID %q does not match the id_token sub %q", huaweiUser.OpenID, claims.Sub)
+	}
+
+	// Prioritize using unionID, unless the subject is configured
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  huaweiUser.OpenID,
+		types.SubjectUnionID: huaweiUser.UnionID,
+	})
+	providerUserID, err := selectSubject("huawei", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the email verified by the id_token is trusted, the one of getInfo stays in RawData
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		Email:          email,
+		Name:           huaweiUser.DisplayName,
+		AvatarURL:      huaweiUser.HeadPictureURL,
+		RawData:        huaweiUser,
+	}, nil
+}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Kakao follows OAuth 2.0 on kauth.kakao.com, the user is read from kapi.kakao.com.
+//
+// **Key points**:
+// * The consent items (nickname, profile image, email, ...) are configured in the Kakao Developers console,
+//   no scope is requested by default.
+// * The client secret is optional, it is only sent when it is enabled in the console.
+// * `/v2/user/me` returns a numeric `id` and the profile nested in `kakao_account.profile`,
+//   the email is only used when it is both valid and verified.
+
+type KakaoProvider struct {
+	Name   string
+	config *oauth2.Config
+}
+
+// NewKakaoProvider creates a new Kakao Provider instance, the ClientID is the REST API key
+func NewKakaoProvider(cfg *types.OauthConfig) types.Provider {
+	return &KakaoProvider{
+		Name: types.KAKAO,
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://kauth.kakao.com/oauth/authorize",
+				TokenURL:  "https://kauth.kakao.com/oauth/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+func (p *KakaoProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *KakaoProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *KakaoProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	client := p.config.Client(ctx, token)
+	resp, err := client.Get("https://kapi.kakao.com/v2/user/me")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var kakaoUser struct {
+		ID           int64 `json:"id"`
+		KakaoAccount struct {
+			Profile struct {
+				Nickname          string `json:"nickname"`
+				ProfileImageURL   string `json:"profile_image_url"`
+				ThumbnailImageURL string `json:"thumbnail_image_url"`
+				IsDefaultImage    bool   `json:"is_default_image"`
+			} `json:"profile"`
+			Name            string `json:"name"`
+			Email           string `json:"email"`
+			IsEmailValid    bool   `json:"is_email_valid"`
+			IsEmailVerified bool   `json:"is_email_verified"`
+			PhoneNumber     string `json:"phone_number"`
+		} `json:"kakao_account"`
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+
+	if err := json.Unmarshal(body, &kakaoUser); err != nil {
+		return nil, err
+	}
+	if kakaoUser.Code != 0 || kakaoUser.ID == 0 {
+		return nil, fmt.Errorf("kakao error: %d %s", kakaoUser.Code, kakaoUser.Msg)
+	}
+
+	account := kakaoUser.KakaoAccount
+	name := account.Profile.Nickname
+	if name == "" {
+		name = account.Name
+	}
+	email := ""
+	if account.IsEmailValid && account.IsEmailVerified {
+		email = account.Email
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: strconv.FormatInt(kakaoUser.ID, 10),
+		Email:          email,
+		Name:           name,
+		AvatarURL:      account.Profile.ProfileImageURL,
+		Phone:          account.PhoneNumber,
+		RawData:        kakaoUser,
+	}, nil
+}
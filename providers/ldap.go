@@ -0,0 +1,338 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// LDAP (and Active Directory) is not OAuth, the user submits the directory username and password to the app.
+//
+// **Key points**:
+// * Search-then-bind: the service account (ClientID is its DN, ClientSecret its password, anonymous when empty)
+//   searches `Extra["BaseDN"]` with `Extra["UserFilter"]` for the user entry, then the user DN is bound with the password.
+// * `Extra["URL"]` is `ldaps://` or `ldap://` with `Extra["StartTLS"]`, `Extra["TLSConfig"]` (*tls.Config) customizes the TLS.
+//   Plain `ldap://` would send the passwords in cleartext, it is refused unless `Extra["Insecure"]` is set.
+// * Empty passwords are rejected: most servers accept them as an unauthenticated bind, which always succeeds.
+// * Groups are the `memberOf` DNs of the user, `Extra["NestedGroups"]` also resolves the groups of the groups.
+//   Active Directory resolves them server side (LDAP_MATCHING_RULE_IN_CHAIN), other servers are walked breadth first.
+// * ProviderUserID is the AD `objectGUID` or the `entryUUID` (stable across renames), or `Extra["SubjectAttribute"]`.
+// * It implements types.CredentialVerifier instead of types.Provider, the credentials are `username` and `password`.
+
+const (
+	// defaultLDAPUserFilter matches the AD sAMAccountName or userPrincipalName and the OpenLDAP uid
+	defaultLDAPUserFilter = "(&(objectClass=person)(|(sAMAccountName={username})(userPrincipalName={username})(uid={username})))"
+	// defaultLDAPTimeout bounds each LDAP request, unless the context has an earlier deadline
+	defaultLDAPTimeout = 10 * time.Second
+	// ldapMatchingRuleInChain is the AD matching rule resolving nested group memberships
+	ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+	// maxLDAPGroupDepth bounds the walk of nested groups
+	maxLDAPGroupDepth = 10
+)
+
+// ldapDialer opens a connection to the directory server
+type ldapDialer func(ctx context.Context) (ldap.Client, error)
+
+type LDAPProvider struct {
+	Name             string
+	bindDN           string
+	bindPassword     string
+	baseDN           string
+	userFilter       string
+	nestedGroups     bool
+	subjectAttribute string
+	emailAttribute   string
+	nameAttribute    string
+	timeout          time.Duration
+	dial             ldapDialer
+}
+
+// LDAPUser is the directory entry of the user, the RawData of the LDAP UserInfo
+type LDAPUser struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+	Groups     []string            `json:"groups"`
+}
+
+// Attribute returns the first value of the attribute name, or ""
+func (u *LDAPUser) Attribute(name string) string {
+	if values := u.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// NewLDAPProvider creates a new LDAP verifier, the ClientID and ClientSecret are the DN and password of the service account
+//
+// Extra fields: `URL`, `StartTLS`, `Insecure` (allow plain ldap://), `TLSConfig`, `BaseDN`, `UserFilter` (`{username}` is replaced by the escaped username),
+// `NestedGroups`, `SubjectAttribute`, `EmailAttribute` (`mail` by default), `NameAttribute` (`displayName` by default),
+// and `Timeout`.
+func NewLDAPProvider(cfg *types.OauthConfig) types.CredentialVerifier {
+	userFilter := extraString(cfg, "UserFilter")
+	if userFilter == "" {
+		userFilter = defaultLDAPUserFilter
+	}
+	emailAttribute := extraString(cfg, "EmailAttribute")
+	if emailAttribute == "" {
+		emailAttribute = "mail"
+	}
+	nameAttribute := extraString(cfg, "NameAttribute")
+	if nameAttribute == "" {
+		nameAttribute = "displayName"
+	}
+	timeout := extraDuration(cfg, "Timeout")
+	if timeout <= 0 {
+		timeout = defaultLDAPTimeout
+	}
+
+	p := &LDAPProvider{
+		Name:             types.LDAP,
+		bindDN:           cfg.ClientID,
+		bindPassword:     cfg.ClientSecret,
+		baseDN:           extraString(cfg, "BaseDN"),
+		userFilter:       userFilter,
+		nestedGroups:     extraBool(cfg, "NestedGroups"),
+		subjectAttribute: extraString(cfg, "SubjectAttribute"),
+		emailAttribute:   emailAttribute,
+		nameAttribute:    nameAttribute,
+		timeout:          timeout,
+	}
+
+	tlsConfig, _ := cfg.Extra["TLSConfig"].(*tls.Config)
+	p.dial = ldapURLDialer(extraString(cfg, "URL"), extraBool(cfg, "StartTLS"), extraBool(cfg, "Insecure"), tlsConfig, timeout)
+	return p
+}
+
+// ldapURLDialer dials ldap:// or ldaps:// URLs, upgrading ldap:// connections with StartTLS.
+// Plain ldap:// connections are only opened if insecure is set.
+func ldapURLDialer(ldapURL string, startTLS, insecure bool, tlsConfig *tls.Config, timeout time.Duration) ldapDialer {
+	return func(ctx context.Context) (ldap.Client, error) {
+		u, err := url.Parse(ldapURL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			return nil, fmt.Errorf("ldap error: invalid URL %q", ldapURL)
+		}
+		if u.Scheme == "ldap" && !startTLS && !insecure {
+			return nil, fmt.Errorf("ldap error: %s is not encrypted, use ldaps:// or StartTLS (or set Insecure)", ldapURL)
+		}
+
+		config := tlsConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+
+		conn, err := ldap.DialURL(ldapURL, ldap.DialWithTLSDialer(config, &net.Dialer{Timeout: timeout}))
+		if err != nil {
+			return nil, fmt.Errorf("ldap error: %w", err)
+		}
+		if startTLS && u.Scheme == "ldap" {
+			if err := conn.StartTLS(config); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("ldap error: StartTLS failed: %w", err)
+			}
+		}
+		return conn, nil
+	}
+}
+
+// VerifyCredentials checks the `username` and `password` against the directory and returns the user
+func (p *LDAPProvider) VerifyCredentials(ctx context.Context, credentials url.Values) (*types.UserInfo, error) {
+	username, password := strings.TrimSpace(credentials.Get("username")), credentials.Get("password")
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("ldap error: username and password are required")
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := p.timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	conn.SetTimeout(timeout)
+
+	if err := p.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+
+	entry, err := p.searchUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("ldap error: invalid credentials")
+		}
+		return nil, fmt.Errorf("ldap error: %w", err)
+	}
+
+	ldapUser := &LDAPUser{
+		DN:         entry.DN,
+		Attributes: make(map[string][]string),
+		Groups:     entry.GetAttributeValues("memberOf"),
+	}
+	for _, attribute := range entry.Attributes {
+		if attribute.Name == "objectGUID" {
+			ldapUser.Attributes[attribute.Name] = []string{formatObjectGUID(entry.GetRawAttributeValue(attribute.Name))}
+			continue
+		}
+		ldapUser.Attributes[attribute.Name] = attribute.Values
+	}
+
+	if p.nestedGroups {
+		// The user may not be allowed to read the groups, they are resolved as the service account again
+		if err := p.bindServiceAccount(conn); err != nil {
+			return nil, err
+		}
+		if ldapUser.Groups, err = p.resolveNestedGroups(conn, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.userInfo(ldapUser)
+}
+
+func (p *LDAPProvider) bindServiceAccount(conn ldap.Client) error {
+	if p.bindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(p.bindDN, p.bindPassword); err != nil {
+		return fmt.Errorf("ldap error: service account bind failed: %w", err)
+	}
+	return nil
+}
+
+// searchUser finds the single entry of username
+func (p *LDAPProvider) searchUser(conn ldap.Client, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(p.userFilter, "{username}", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		p.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, []string{"*", "objectGUID", "entryUUID", "memberOf"}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldap error: user search failed: %w", err)
+	}
+	if result == nil || len(result.Entries) == 0 {
+		// The same error as a wrong password, so that usernames can not be enumerated
+		return nil, fmt.Errorf("ldap error: invalid credentials")
+	}
+	if len(result.Entries) > 1 {
+		// Reported to the operator only, the user gets the same error as a wrong password
+		log.Printf("ldap: the user filter matches several entries for username %q, check UserFilter", username)
+		return nil, fmt.Errorf("ldap error: invalid credentials")
+	}
+	return result.Entries[0], nil
+}
+
+// resolveNestedGroups returns every group the user is a direct or indirect member of
+func (p *LDAPProvider) resolveNestedGroups(conn ldap.Client, entry *ldap.Entry) ([]string, error) {
+	// Active Directory entries have an objectGUID, the matching rule walks the chain on the server
+	if len(entry.GetRawAttributeValue("objectGUID")) > 0 {
+		result, err := conn.SearchWithPaging(ldap.NewSearchRequest(
+			p.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf("(member:%s:=%s)", ldapMatchingRuleInChain, ldap.EscapeFilter(entry.DN)), []string{"dn"}, nil,
+		), 500)
+		if err != nil {
+			return nil, fmt.Errorf("ldap error: nested group search failed: %w", err)
+		}
+		groups := make([]string, 0, len(result.Entries))
+		for _, group := range result.Entries {
+			groups = append(groups, group.DN)
+		}
+		return groups, nil
+	}
+
+	// Other servers: breadth-first walk over the memberOf of each group, groups may be nested in cycles
+	seen := make(map[string]bool)
+	groups := make([]string, 0)
+	pending := entry.GetAttributeValues("memberOf")
+	for depth := 0; len(pending) > 0 && depth < maxLDAPGroupDepth; depth++ {
+		var next []string
+		for _, groupDN := range pending {
+			if seen[strings.ToLower(groupDN)] {
+				continue
+			}
+			seen[strings.ToLower(groupDN)] = true
+			groups = append(groups, groupDN)
+
+			result, err := conn.Search(ldap.NewSearchRequest(
+				groupDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+				"(objectClass=*)", []string{"memberOf"}, nil,
+			))
+			if err != nil {
+				// A group outside the readable tree still counts, its parents are not resolved
+				if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights) {
+					continue
+				}
+				return nil, fmt.Errorf("ldap error: group search failed: %w", err)
+			}
+			for _, group := range result.Entries {
+				next = append(next, group.GetAttributeValues("memberOf")...)
+			}
+		}
+		pending = next
+	}
+	return groups, nil
+}
+
+func (p *LDAPProvider) userInfo(ldapUser *LDAPUser) (*types.UserInfo, error) {
+	subject := ""
+	if p.subjectAttribute != "" {
+		subject = ldapUser.Attribute(p.subjectAttribute)
+		if subject == "" {
+			return nil, fmt.Errorf("ldap error: attribute %s is missing", p.subjectAttribute)
+		}
+	} else {
+		subject = selectFirst(ldapUser.Attribute("objectGUID"), ldapUser.Attribute("entryUUID"), ldapUser.DN)
+	}
+
+	username := selectFirst(ldapUser.Attribute("sAMAccountName"), ldapUser.Attribute("uid"))
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: subject,
+		AlternateIDs:   compactIDs(map[string]string{"dn": ldapUser.DN, "username": username}),
+		Email:          ldapUser.Attribute(p.emailAttribute),
+		Name:           selectFirst(ldapUser.Attribute(p.nameAttribute), ldapUser.Attribute("cn"), username),
+		Phone:          selectFirst(ldapUser.Attribute("mobile"), ldapUser.Attribute("telephoneNumber")),
+		Groups:         ldapUser.Groups,
+		RawData:        ldapUser,
+	}, nil
+}
+
+// selectFirst returns the first non-empty value
+func selectFirst(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// formatObjectGUID formats the binary AD objectGUID, whose first three groups are little-endian
+func formatObjectGUID(guid []byte) string {
+	if len(guid) != 16 {
+		return fmt.Sprintf("%x", guid)
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x",
+		guid[3], guid[2], guid[1], guid[0], guid[5], guid[4], guid[7], guid[6], guid[8:10], guid[10:])
+}
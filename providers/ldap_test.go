@@ -0,0 +1,593 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+const (
+	testLDAPBaseDN        = "dc=example,dc=org"
+	testLDAPServiceDN     = "cn=authkit,ou=services,dc=example,dc=org"
+	testLDAPServicePasswd = "service-secret"
+	// ldapStartTLSOID is the StartTLS extended operation
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// ldapServer is an in-process LDAP server on a loopback listener, speaking the BER protocol of RFC 4511.
+// It serves simple binds, StartTLS, searches (and/or/not, equality, presence and the AD in-chain match)
+// and the paged results control, over a self-signed certificate trusted by clientTLSConfig.
+type ldapServer struct {
+	url             string
+	clientTLSConfig *tls.Config
+	tlsConfig       *tls.Config
+	// pageSize caps the pages of paged searches, so that a result spans several pages
+	pageSize int
+
+	mu        sync.Mutex
+	entries   []*ldap.Entry
+	passwords map[string]string
+	conns     []net.Conn
+	ops       ldapOperations
+}
+
+// ldapOperations records the operations served
+type ldapOperations struct {
+	// binds are the DNs bound, in order
+	binds    []string
+	startTLS int
+	pages    int
+}
+
+// newLDAPServer listens for ldap:// connections, or ldaps:// ones if ldaps is set
+func newLDAPServer(t *testing.T, ldaps bool) *ldapServer {
+	certificate, key := newTestCertificate(t, "ldap.example.org")
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	s := &ldapServer{
+		clientTLSConfig: &tls.Config{RootCAs: roots},
+		tlsConfig:       &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certificate.Raw}, PrivateKey: key}}},
+		passwords:       map[string]string{testLDAPServiceDN: testLDAPServicePasswd},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.url = "ldap://" + listener.Addr().String()
+	if ldaps {
+		listener = tls.NewListener(listener, s.tlsConfig)
+		s.url = "ldaps://" + listener.Addr().String()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		s.mu.Lock()
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	})
+	return s
+}
+
+// add adds an entry, with a password if not empty
+func (s *ldapServer) add(dn, password string, attributes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, ldap.NewEntry(dn, attributes))
+	if password != "" {
+		s.passwords[dn] = password
+	}
+}
+
+// dials returns the number of connections accepted
+func (s *ldapServer) dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// operations returns the operations served so far
+func (s *ldapServer) operations() ldapOperations {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := s.ops
+	ops.binds = slices.Clone(s.ops.binds)
+	return ops
+}
+
+func (s *ldapServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, _ := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		s.mu.Lock()
+		var responses []*ber.Packet
+		upgrade := false
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{s.bind(messageID, request)}
+		case ldap.ApplicationSearchRequest:
+			var controls []*ber.Packet
+			if len(packet.Children) > 2 {
+				controls = packet.Children[2].Children
+			}
+			responses = s.search(messageID, request, controls)
+		case ldap.ApplicationExtendedRequest:
+			if request.Children[0].Data.String() == ldapStartTLSOID {
+				s.ops.startTLS++
+				upgrade = true
+				responses = []*ber.Packet{ldapResponse(messageID, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess, ""))}
+			} else {
+				responses = []*ber.Packet{ldapResponse(messageID, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError, "unsupported extended operation"))}
+			}
+		case ldap.ApplicationUnbindRequest:
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		for _, response := range responses {
+			if _, err := conn.Write(response.Bytes()); err != nil {
+				return
+			}
+		}
+		if upgrade {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+	}
+}
+
+func (s *ldapServer) bind(messageID int64, request *ber.Packet) *ber.Packet {
+	dn, password := request.Children[1].Data.String(), request.Children[2].Data.String()
+	s.ops.binds = append(s.ops.binds, dn)
+	if expected, ok := s.passwords[dn]; !ok || expected != password {
+		return ldapResponse(messageID, ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, "invalid credentials"))
+	}
+	return ldapResponse(messageID, ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, ""))
+}
+
+func (s *ldapServer) search(messageID int64, request *ber.Packet, controls []*ber.Packet) []*ber.Packet {
+	baseDN := request.Children[0].Data.String()
+	scope, _ := request.Children[1].Value.(int64)
+	sizeLimit, _ := request.Children[3].Value.(int64)
+	filter := request.Children[6]
+
+	var matched []*ldap.Entry
+	if scope == ldap.ScopeBaseObject {
+		entry := s.entry(baseDN)
+		if entry == nil {
+			return []*ber.Packet{ldapResponse(messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, "no such object"))}
+		}
+		if s.match(entry, filter) {
+			matched = append(matched, entry)
+		}
+	} else {
+		for _, entry := range s.entries {
+			if strings.HasSuffix(strings.ToLower(entry.DN), ","+strings.ToLower(baseDN)) && s.match(entry, filter) {
+				matched = append(matched, entry)
+			}
+		}
+	}
+
+	code := uint16(ldap.LDAPResultSuccess)
+	if sizeLimit > 0 && len(matched) > int(sizeLimit) {
+		matched, code = matched[:sizeLimit], ldap.LDAPResultSizeLimitExceeded
+	}
+
+	// Paged results (RFC 2696), the cookie is the offset of the next page
+	var pagingControl *ldap.ControlPaging
+	for _, packet := range controls {
+		if control, err := ldap.DecodeControl(packet); err == nil && control.GetControlType() == ldap.ControlTypePaging {
+			pagingControl = control.(*ldap.ControlPaging)
+		}
+	}
+	var responseControls []*ber.Packet
+	if pagingControl != nil {
+		s.ops.pages++
+		offset, _ := strconv.Atoi(string(pagingControl.Cookie))
+		size := int(pagingControl.PagingSize)
+		if s.pageSize > 0 && s.pageSize < size {
+			size = s.pageSize
+		}
+		matched = matched[min(offset, len(matched)):]
+		next := ldap.NewControlPaging(0)
+		if len(matched) > size {
+			matched = matched[:size]
+			next.SetCookie([]byte(strconv.Itoa(offset + size)))
+		}
+		responseControls = append(responseControls, next.Encode())
+	}
+
+	responses := make([]*ber.Packet, 0, len(matched)+1)
+	for _, entry := range matched {
+		responses = append(responses, ldapResponse(messageID, ldapSearchResultEntry(entry)))
+	}
+	return append(responses, ldapResponse(messageID, ldapResult(ldap.ApplicationSearchResultDone, code, ""), responseControls...))
+}
+
+func (s *ldapServer) entry(dn string) *ldap.Entry {
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// match evaluates the BER filter on entry, values are compared case-insensitively
+func (s *ldapServer) match(entry *ldap.Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !s.match(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if s.match(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !s.match(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		value := filter.Children[1].Data.String()
+		return slices.ContainsFunc(ldapValues(entry, filter.Children[0].Data.String()), func(v string) bool { return strings.EqualFold(v, value) })
+	case ldap.FilterPresent:
+		return strings.EqualFold(filter.Data.String(), "objectClass") || len(ldapValues(entry, filter.Data.String())) > 0
+	case ldap.FilterExtensibleMatch:
+		var rule, attribute, value string
+		for _, child := range filter.Children {
+			// MatchingRuleAssertion: matchingRule [1], type [2] and matchValue [3]
+			switch child.Tag {
+			case 1:
+				rule = child.Data.String()
+			case 2:
+				attribute = child.Data.String()
+			case 3:
+				value = child.Data.String()
+			}
+		}
+		return rule == ldapMatchingRuleInChain && strings.EqualFold(attribute, "member") && s.inChain(entry, value)
+	}
+	return false
+}
+
+// inChain reports whether dn is a direct or nested member of group
+func (s *ldapServer) inChain(group *ldap.Entry, dn string) bool {
+	seen := make(map[string]bool)
+	pending := ldapValues(group, "member")
+	for len(pending) > 0 {
+		member := pending[0]
+		pending = pending[1:]
+		if strings.EqualFold(member, dn) {
+			return true
+		}
+		if seen[strings.ToLower(member)] {
+			continue
+		}
+		seen[strings.ToLower(member)] = true
+		if nested := s.entry(member); nested != nil {
+			pending = append(pending, ldapValues(nested, "member")...)
+		}
+	}
+	return false
+}
+
+// ldapValues returns the values of the attribute name of entry, names are case-insensitive
+func ldapValues(entry *ldap.Entry, name string) []string {
+	for _, attribute := range entry.Attributes {
+		if strings.EqualFold(attribute.Name, name) {
+			return attribute.Values
+		}
+	}
+	return nil
+}
+
+func ldapResponse(messageID int64, response *ber.Packet, controls ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(response)
+	if len(controls) > 0 {
+		packetControls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			packetControls.AppendChild(control)
+		}
+		packet.AppendChild(packetControls)
+	}
+	return packet
+}
+
+func ldapResult(application uint8, code uint16, diagnostic string) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(application), nil, ldap.ApplicationMap[application])
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diagnostic, "diagnosticMessage"))
+	return result
+}
+
+func ldapSearchResultEntry(entry *ldap.Entry) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "objectName"))
+	attributes := ber.NewSequence("attributes")
+	for _, attribute := range entry.Attributes {
+		packet := ber.NewSequence("attribute")
+		packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range attribute.ByteValues {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value), "value"))
+		}
+		packet.AppendChild(values)
+		attributes.AppendChild(packet)
+	}
+	result.AppendChild(attributes)
+	return result
+}
+
+// newTestLDAPProvider dials server through its URL, ldap:// URLs are upgraded with StartTLS
+func newTestLDAPProvider(server *ldapServer, extra map[string]any) types.CredentialVerifier {
+	cfg := &types.OauthConfig{
+		ClientID:     testLDAPServiceDN,
+		ClientSecret: testLDAPServicePasswd,
+		Extra: map[string]any{
+			"URL":       server.url,
+			"StartTLS":  strings.HasPrefix(server.url, "ldap://"),
+			"TLSConfig": server.clientTLSConfig,
+			"BaseDN":    testLDAPBaseDN,
+		},
+	}
+	for k, v := range extra {
+		cfg.Extra[k] = v
+	}
+	return NewLDAPProvider(cfg)
+}
+
+func ldapCredentials(username, password string) url.Values {
+	return url.Values{"username": {username}, "password": {password}}
+}
+
+// newOpenLDAPServer has alice, member of a cycle of nested groups and of a group outside the readable tree
+func newOpenLDAPServer(t *testing.T, ldaps bool) *ldapServer {
+	server := newLDAPServer(t, ldaps)
+	server.add("uid=alice,ou=people,dc=example,dc=org", "alice-secret", map[string][]string{
+		"objectClass": {"top", "person", "inetOrgPerson"},
+		"uid":         {"alice"},
+		"entryUUID":   {"5b0a4ba4-1b6f-4c1e-9a5e-2f7c1a0d6e11"},
+		"mail":        {"alice@example.org"},
+		"displayName": {"Alice"},
+		"memberOf":    {"cn=developers,ou=groups,dc=example,dc=org"},
+	})
+	server.add("cn=developers,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"memberOf":    {"cn=engineering,ou=groups,dc=example,dc=org"},
+	})
+	server.add("cn=engineering,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		// developers is nested in engineering, which is nested in developers again
+		"memberOf": {"CN=Developers,ou=groups,dc=example,dc=org", "cn=all,ou=hidden,dc=example,dc=org"},
+	})
+	return server
+}
+
+func TestLDAPVerifyCredentials(t *testing.T) {
+	for _, ldaps := range []bool{false, true} {
+		server := newOpenLDAPServer(t, ldaps)
+		p := newTestLDAPProvider(server, nil)
+
+		userInfo, err := p.VerifyCredentials(context.Background(), ldapCredentials("alice", "alice-secret"))
+		if err != nil {
+			t.Fatalf("%s: %v", server.url, err)
+		}
+
+		// ldap:// is upgraded with StartTLS before any bind, ldaps:// is encrypted from the start
+		ops := server.operations()
+		if wantStartTLS := map[bool]int{false: 1, true: 0}[ldaps]; ops.startTLS != wantStartTLS {
+			t.Fatalf("%s: %d StartTLS, want %d", server.url, ops.startTLS, wantStartTLS)
+		}
+		// Search-then-bind: the service account searches, then the user DN is bound
+		wantBinds := []string{testLDAPServiceDN, "uid=alice,ou=people,dc=example,dc=org"}
+		if !slices.Equal(ops.binds, wantBinds) {
+			t.Fatalf("binds = %v, want %v", ops.binds, wantBinds)
+		}
+		if userInfo.ProviderUserID != "5b0a4ba4-1b6f-4c1e-9a5e-2f7c1a0d6e11" {
+			t.Fatalf("ProviderUserID = %q, want the entryUUID", userInfo.ProviderUserID)
+		}
+		if userInfo.Email != "alice@example.org" || userInfo.Name != "Alice" {
+			t.Fatalf("unexpected user info %+v", userInfo)
+		}
+		if userInfo.AlternateIDs["username"] != "alice" || userInfo.AlternateIDs["dn"] != "uid=alice,ou=people,dc=example,dc=org" {
+			t.Fatalf("AlternateIDs = %v", userInfo.AlternateIDs)
+		}
+		// Without NestedGroups, the groups are the direct memberOf
+		if !slices.Equal(userInfo.Groups, []string{"cn=developers,ou=groups,dc=example,dc=org"}) {
+			t.Fatalf("Groups = %v", userInfo.Groups)
+		}
+	}
+}
+
+func TestLDAPUntrustedCertificate(t *testing.T) {
+	for _, ldaps := range []bool{false, true} {
+		server := newOpenLDAPServer(t, ldaps)
+		// The system roots do not trust the self-signed certificate of the server
+		p := newTestLDAPProvider(server, map[string]any{"TLSConfig": nil})
+
+		if _, err := p.VerifyCredentials(context.Background(), ldapCredentials("alice", "alice-secret")); err == nil {
+			t.Fatalf("%s: untrusted certificate accepted", server.url)
+		}
+		if binds := server.operations().binds; len(binds) != 0 {
+			t.Fatalf("%s: bound %v over an untrusted connection", server.url, binds)
+		}
+	}
+}
+
+func TestLDAPVerifyCredentialsRejected(t *testing.T) {
+	server := newOpenLDAPServer(t, false)
+	server.add("uid=bob,ou=people,dc=example,dc=org", "bob-secret", map[string][]string{"objectClass": {"person"}, "uid": {"bob"}})
+	server.add("uid=bob,ou=contractors,dc=example,dc=org", "bob-secret", map[string][]string{"objectClass": {"person"}, "uid": {"bob"}})
+	p := newTestLDAPProvider(server, nil)
+	ctx := context.Background()
+
+	_, wrongPassword := p.VerifyCredentials(ctx, ldapCredentials("alice", "wrong"))
+	if wrongPassword == nil || wrongPassword.Error() != "ldap error: invalid credentials" {
+		t.Fatalf("wrong password: err = %v", wrongPassword)
+	}
+
+	// Unknown users, filter metacharacters and ambiguous usernames get the same error, so that usernames can not be enumerated
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	for _, username := range []string{"mallory", "*", "alice)(uid=*", "bob"} {
+		if _, err := p.VerifyCredentials(ctx, ldapCredentials(username, "bob-secret")); err == nil || err.Error() != wrongPassword.Error() {
+			t.Fatalf("username %q: err = %v, want %v", username, err, wrongPassword)
+		}
+	}
+	// The ambiguity is only reported to the operator
+	if !strings.Contains(logs.String(), "several entries") {
+		t.Fatalf("ambiguous username not logged: %q", logs.String())
+	}
+
+	// An empty password would be an unauthenticated bind, it is rejected before dialing
+	dials := server.dials()
+	if _, err := p.VerifyCredentials(ctx, ldapCredentials("alice", "")); err == nil {
+		t.Fatal("empty password accepted")
+	}
+	if server.dials() != dials {
+		t.Fatal("the directory was dialed for an empty password")
+	}
+}
+
+func TestLDAPNestedGroupsCycle(t *testing.T) {
+	server := newOpenLDAPServer(t, false)
+	p := newTestLDAPProvider(server, map[string]any{"NestedGroups": true})
+
+	userInfo, err := p.VerifyCredentials(context.Background(), ldapCredentials("alice", "alice-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cycle is walked once, the unreadable group still counts
+	wantGroups := []string{
+		"cn=developers,ou=groups,dc=example,dc=org",
+		"cn=engineering,ou=groups,dc=example,dc=org",
+		"cn=all,ou=hidden,dc=example,dc=org",
+	}
+	if !slices.Equal(userInfo.Groups, wantGroups) {
+		t.Fatalf("Groups = %v, want %v", userInfo.Groups, wantGroups)
+	}
+	// The groups are resolved as the service account again
+	if binds := server.operations().binds; binds[len(binds)-1] != testLDAPServiceDN {
+		t.Fatalf("groups resolved as %s", binds[len(binds)-1])
+	}
+}
+
+func TestLDAPActiveDirectory(t *testing.T) {
+	// The objectGUID 12345678-1234-5678-1234-56789abcdef0, the first three groups are little-endian
+	guid := []byte{0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+
+	server := newLDAPServer(t, true)
+	server.pageSize = 1
+	userDN := "CN=Carol,OU=Users,DC=example,DC=org"
+	server.add(userDN, "carol-secret", map[string][]string{
+		"objectClass":    {"top", "person", "organizationalPerson", "user"},
+		"sAMAccountName": {"carol"},
+		"objectGUID":     {string(guid)},
+		"memberOf":       {"CN=Admins,OU=Groups,DC=example,DC=org"},
+	})
+	server.add("CN=Admins,OU=Groups,DC=example,DC=org", "", map[string][]string{"objectClass": {"group"}, "member": {userDN}})
+	server.add("CN=Staff,OU=Groups,DC=example,DC=org", "", map[string][]string{"objectClass": {"group"}, "member": {"CN=Admins,OU=Groups,DC=example,DC=org"}})
+	server.add("CN=Others,OU=Groups,DC=example,DC=org", "", map[string][]string{"objectClass": {"group"}, "member": {"CN=Dave,OU=Users,DC=example,DC=org"}})
+	p := newTestLDAPProvider(server, map[string]any{"NestedGroups": true})
+
+	userInfo, err := p.VerifyCredentials(context.Background(), ldapCredentials("carol", "carol-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.ProviderUserID != "12345678-1234-5678-1234-56789abcdef0" {
+		t.Fatalf("ProviderUserID = %q, want the formatted objectGUID", userInfo.ProviderUserID)
+	}
+	if userInfo.Name != "carol" {
+		t.Fatalf("Name = %q, want the sAMAccountName", userInfo.Name)
+	}
+	// Resolved server side by LDAP_MATCHING_RULE_IN_CHAIN, over several pages
+	wantGroups := []string{"CN=Admins,OU=Groups,DC=example,DC=org", "CN=Staff,OU=Groups,DC=example,DC=org"}
+	if !slices.Equal(userInfo.Groups, wantGroups) {
+		t.Fatalf("Groups = %v, want %v", userInfo.Groups, wantGroups)
+	}
+	if pages := server.operations().pages; pages != 2 {
+		t.Fatalf("%d pages served, want 2", pages)
+	}
+
+	if got := formatObjectGUID([]byte{0x01, 0x02}); got != "0102" {
+		t.Fatalf("formatObjectGUID of a short value = %q", got)
+	}
+}
+
+func TestLDAPPlainURL(t *testing.T) {
+	server := newOpenLDAPServer(t, false)
+
+	p := newTestLDAPProvider(server, map[string]any{"StartTLS": false})
+	_, err := p.VerifyCredentials(context.Background(), ldapCredentials("alice", "alice-secret"))
+	if err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Fatalf("err = %v, want plain ldap:// refused", err)
+	}
+	if server.dials() != 0 {
+		t.Fatal("the directory was dialed over plain ldap://")
+	}
+
+	// Insecure allows cleartext binds, e.g. to a directory on the same host
+	p = newTestLDAPProvider(server, map[string]any{"StartTLS": false, "Insecure": true})
+	if _, err := p.VerifyCredentials(context.Background(), ldapCredentials("alice", "alice-secret")); err != nil {
+		t.Fatal(err)
+	}
+	if startTLS := server.operations().startTLS; startTLS != 0 {
+		t.Fatalf("%d StartTLS with Insecure", startTLS)
+	}
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// LINE Login v2.1 is an OpenID Connect flow.
+//
+// **Key points**:
+// * The id_token of web logins is signed with HS256 and the channel secret, native app logins use ES256
+//   with the keys of https://api.line.me/oauth2/v2.1/certs, both are verified.
+// * The `email` claim requires the "OpenID Connect email" permission applied for in the LINE Developers console,
+//   the `email` scope is only requested with `Extra["RequestEmail"]`.
+// * Without id_token (e.g. a token restored from storage) the profile comes from `/v2/profile`, without the email.
+
+const (
+	lineIssuer  = "https://access.line.me"
+	lineCertURL = "https://api.line.me/oauth2/v2.1/certs"
+)
+
+type LineProvider struct {
+	Name   string
+	config *oauth2.Config
+}
+
+// LineClaims are the claims of the LINE id_token
+type LineClaims struct {
+	Name    string `json:"name"`
+	Picture string `json:"picture"`
+	Email   string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// NewLineProvider creates a new LINE Provider instance, the ClientID is the channel ID and the ClientSecret the channel secret
+//
+// Extra fields: `RequestEmail` (request the email scope, the channel needs the email permission).
+func NewLineProvider(cfg *types.OauthConfig) types.Provider {
+	scopes := []string{"profile", oidc.ScopeOpenID}
+	if extraBool(cfg, "RequestEmail") {
+		scopes = append(scopes, "email")
+	}
+
+	return &LineProvider{
+		Name: types.LINE,
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://access.line.me/oauth2/v2.1/authorize",
+				TokenURL:  "https://api.line.me/oauth2/v2.1/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+func (p *LineProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *LineProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *LineProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	idTokenStr, ok := token.Extra("id_token").(string)
+	if !ok || idTokenStr == "" {
+		return p.getProfile(ctx, token)
+	}
+
+	claims, err := p.VerifyIDToken(ctx, idTokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: claims.Subject,
+		Email:          claims.Email,
+		Name:           claims.Name,
+		AvatarURL:      claims.Picture,
+		RawData:        claims,
+	}, nil
+}
+
+// VerifyIDToken verifies a LINE id_token, signed either with the channel secret (HS256) or the LINE keys (ES256)
+func (p *LineProvider) VerifyIDToken(ctx context.Context, rawIDToken string) (*LineClaims, error) {
+	claims := &LineClaims{}
+
+	parser := jwt.NewParser()
+	unverified, _, err := parser.ParseUnverified(rawIDToken, claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse line id_token: %w", err)
+	}
+
+	if unverified.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		_, err := jwt.ParseWithClaims(rawIDToken, claims, func(t *jwt.Token) (any, error) {
+			return []byte(p.config.ClientSecret), nil
+		},
+			jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+			jwt.WithIssuer(lineIssuer),
+			jwt.WithAudience(p.config.ClientID),
+			jwt.WithExpirationRequired(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify line id_token: %w", err)
+		}
+		return claims, nil
+	}
+
+	keySet := oidc.NewRemoteKeySet(ctx, lineCertURL)
+	verifier := oidc.NewVerifier(lineIssuer, keySet, &oidc.Config{
+		ClientID:             p.config.ClientID,
+		SupportedSigningAlgs: []string{oidc.ES256},
+	})
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify line id_token: %w", err)
+	}
+	claims = &LineClaims{}
+	if err := idToken.Claims(claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal line id_token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// getProfile reads the user profile with the access token, the email is not available there
+func (p *LineProvider) getProfile(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	client := p.config.Client(ctx, token)
+	resp, err := client.Get("https://api.line.me/v2/profile")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var lineUser struct {
+		UserID        string `json:"userId"`
+		DisplayName   string `json:"displayName"`
+		PictureURL    string `json:"pictureUrl"`
+		StatusMessage string `json:"statusMessage"`
+		Message       string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &lineUser); err != nil {
+		return nil, err
+	}
+	if lineUser.UserID == "" {
+		return nil, fmt.Errorf("line error: %s", lineUser.Message)
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: lineUser.UserID,
+		Name:           lineUser.DisplayName,
+		AvatarURL:      lineUser.PictureURL,
+		RawData:        lineUser,
+	}, nil
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// LinkedIn login uses the "Sign In with LinkedIn using OpenID Connect" product.
+//
+// **Key points**:
+// * The `openid profile email` scopes return an id_token, verified against https://www.linkedin.com/oauth.
+// * The profile comes from the `/v2/userinfo` endpoint, whose `sub` must match the id_token one.
+// * An email which is not `email_verified` is not put in the UserInfo, to prevent linking accounts by an unverified email.
+
+const linkedinIssuer = "https://www.linkedin.com/oauth"
+
+type LinkedinProvider struct {
+	Name   string
+	config *oauth2.Config
+}
+
+// NewLinkedinProvider creates a new LinkedIn Provider instance
+func NewLinkedinProvider(cfg *types.OauthConfig) types.Provider {
+	return &LinkedinProvider{
+		Name: types.LINKEDIN,
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://www.linkedin.com/oauth/v2/authorization",
+				TokenURL:  "https://www.linkedin.com/oauth/v2/accessToken",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+func (p *LinkedinProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *LinkedinProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *LinkedinProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	// The id_token is only returned by the code exchange, tokens restored from storage may not have it
+	subject := ""
+	if idTokenStr, ok := token.Extra("id_token").(string); ok && idTokenStr != "" {
+		provider, err := oidc.NewProvider(ctx, linkedinIssuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get linkedin oidc provider: %w", err)
+		}
+
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, idTokenStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify linkedin id_token: %w", err)
+		}
+		subject = idToken.Subject
+	}
+
+	client := p.config.Client(ctx, token)
+	resp, err := client.Get("https://api.linkedin.com/v2/userinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var linkedinUser struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+		Picture       string `json:"picture"`
+		Locale        any    `json:"locale"` // either "en-US" or {"country": "US", "language": "en"}
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+
+	if err := json.Unmarshal(body, &linkedinUser); err != nil {
+		return nil, err
+	}
+	if linkedinUser.Sub == "" {
+		return nil, fmt.Errorf("linkedin userinfo error: %s", string(body))
+	}
+	if subject != "" && subject != linkedinUser.Sub {
+		return nil, fmt.Errorf("linkedin userinfo sub %q does not match the id_token sub %q", linkedinUser.Sub, subject)
+	}
+
+	email := ""
+	if linkedinUser.EmailVerified {
+		email = linkedinUser.Email
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: linkedinUser.Sub,
+		Email:          email,
+		Name:           linkedinUser.Name,
+		AvatarURL:      linkedinUser.Picture,
+		RawData:        linkedinUser,
+	}, nil
+}
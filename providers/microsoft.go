@@ -6,29 +6,41 @@ package providers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/oauth2"
 
 	"go.xiexianbin.cn/authkit/types"
 )
 
+// SubjectOID is the Microsoft `SubjectID` using the object ID and tenant ID (`<oid>:<tid>`) of the id_token,
+// which is stable across applications, instead of the Graph `id`
+const SubjectOID = "oid"
+
 type MicrosoftProvider struct {
-	Name   string
-	config *oauth2.Config
+	Name        string
+	config      *oauth2.Config
+	subjectKind string
 }
 
+// NewMicrosoftProvider creates a new Microsoft Provider instance
+//
+// Extra fields: `SubjectID` (`user_id` for the Graph `id` by default, or `oid`).
 func NewMicrosoftProvider(cfg *types.OauthConfig) types.Provider {
 	return &MicrosoftProvider{
-		Name: types.MICROSOFT,
+		Name:        types.MICROSOFT,
+		subjectKind: extraString(cfg, "SubjectID"),
 		config: &oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
 			RedirectURL:  cfg.RedirectURL,
 			Scopes:       []string{"User.Read", "openid", "profile", "email"},
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
-				TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+				AuthURL:       "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+				DeviceAuthURL: "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+				TokenURL:      "https://login.microsoftonline.com/common/oauth2/v2.0/token",
 			},
 		},
 	}
@@ -42,6 +54,14 @@ func (p *MicrosoftProvider) ExchangeCodeForToken(ctx context.Context, code strin
 	return p.config.Exchange(ctx, code, opts...)
 }
 
+func (p *MicrosoftProvider) DeviceAuth(ctx context.Context, opts ...oauth2.AuthCodeOption) (*oauth2.DeviceAuthResponse, error) {
+	return p.config.DeviceAuth(ctx, opts...)
+}
+
+func (p *MicrosoftProvider) DeviceAccessToken(ctx context.Context, da *oauth2.DeviceAuthResponse, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return deviceAccessToken(ctx, p.config, da, opts...)
+}
+
 func (p *MicrosoftProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
 	client := p.config.Client(ctx, token)
 	userInfoURL := "https://graph.microsoft.com/v1.0/me"
@@ -67,12 +87,52 @@ func (p *MicrosoftProvider) GetUserInfo(ctx context.Context, token *oauth2.Token
 		return nil, err
 	}
 
+	ids := map[string]string{types.SubjectUserID: msUser.ID}
+	if claims := microsoftIDTokenClaims(token); claims != nil {
+		ids["oid"] = claims.OID
+		ids["tid"] = claims.TID
+	}
+	ids = compactIDs(ids)
+
+	providerUserID := msUser.ID
+	switch p.subjectKind {
+	case "", types.SubjectUserID:
+	case SubjectOID:
+		if ids["oid"] == "" || ids["tid"] == "" {
+			return nil, fmt.Errorf("microsoft oid is not available, the id_token is missing")
+		}
+		providerUserID = ids["oid"] + ":" + ids["tid"]
+	default:
+		return nil, fmt.Errorf("microsoft %s is not available for this user", p.subjectKind)
+	}
+
 	return &types.UserInfo{
 		Provider:       types.MICROSOFT,
-		ProviderUserID: msUser.ID,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
 		Name:           msUser.DisplayName,
 		Email:          msUser.Mail,
 		AvatarURL:      "", // Microsoft Graph requires a separate call for the photo
 		RawData:        msUser,
 	}, nil
 }
+
+// microsoftIDTokenClaims returns the claims of the id_token returned along with token, or nil.
+// The signature is not checked: the id_token comes straight from the token endpoint over TLS.
+func microsoftIDTokenClaims(token *oauth2.Token) *microsoftClaims {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil
+	}
+	claims := &microsoftClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(rawIDToken, claims); err != nil {
+		return nil
+	}
+	return claims
+}
+
+type microsoftClaims struct {
+	OID string `json:"oid"`
+	TID string `json:"tid"`
+	jwt.RegisteredClaims
+}
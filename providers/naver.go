@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Naver follows OAuth 2.0 on nid.naver.com, the user is read from openapi.naver.com.
+//
+// **Key points**:
+// * The consent items are configured in the Naver Developers console, no scope is requested.
+// * The profile API answers with the `{resultcode, message, response}` envelope, `resultcode` is "00" on success.
+
+type NaverProvider struct {
+	Name   string
+	config *oauth2.Config
+}
+
+// NewNaverProvider creates a new Naver Provider instance
+func NewNaverProvider(cfg *types.OauthConfig) types.Provider {
+	return &NaverProvider{
+		Name: types.NAVER,
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://nid.naver.com/oauth2.0/authorize",
+				TokenURL:  "https://nid.naver.com/oauth2.0/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+func (p *NaverProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *NaverProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *NaverProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	client := p.config.Client(ctx, token)
+	resp, err := client.Get("https://openapi.naver.com/v1/nid/me")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope struct {
+		ResultCode string `json:"resultcode"`
+		Message    string `json:"message"`
+		Response   struct {
+			ID           string `json:"id"`
+			Nickname     string `json:"nickname"`
+			Name         string `json:"name"`
+			Email        string `json:"email"`
+			ProfileImage string `json:"profile_image"`
+			Mobile       string `json:"mobile"`
+			Gender       string `json:"gender"`
+			Age          string `json:"age"`
+			Birthday     string `json:"birthday"`
+			BirthYear    string `json:"birthyear"`
+		} `json:"response"`
+	}
+
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.ResultCode != "00" || envelope.Response.ID == "" {
+		return nil, fmt.Errorf("naver error: %s %s", envelope.ResultCode, envelope.Message)
+	}
+
+	naverUser := envelope.Response
+	name := naverUser.Nickname
+	if name == "" {
+		name = naverUser.Name
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: naverUser.ID,
+		Email:          naverUser.Email,
+		Name:           name,
+		AvatarURL:      naverUser.ProfileImage,
+		Phone:          naverUser.Mobile,
+		RawData:        naverUser,
+	}, nil
+}
@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Generic OpenID Connect provider (Keycloak, Authentik, Okta, Auth0, Dex, ...), configured by discovery.
+//
+// **Key points**:
+// * The endpoints are discovered from `{Extra["Issuer"]}/.well-known/openid-configuration` on first use,
+//   a failed discovery is retried on the next call.
+// * The id_token is verified against the issuer keys, the `sub` of the userinfo endpoint must match it.
+// * The email is only used when `email_verified` is not false.
+// * Device flow (RFC 8628) is supported when the issuer advertises a `device_authorization_endpoint`.
+
+type OIDCProvider struct {
+	Name   string
+	issuer string
+	// mu guards the lazy discovery, which fills the endpoints of config
+	mu       sync.Mutex
+	provider *oidc.Provider
+	config   *oauth2.Config
+}
+
+// OIDCClaims is the RawData of the OIDC UserInfo, the standard claims of the id_token and the userinfo endpoint
+type OIDCClaims struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Picture           string `json:"picture"`
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+	PhoneNumber       string `json:"phone_number"`
+}
+
+// NewOIDCProvider creates a new generic OpenID Connect Provider instance
+//
+// Extra fields: `Issuer` (required) and `Scopes` (`openid profile email` by default).
+func NewOIDCProvider(cfg *types.OauthConfig) types.Provider {
+	scopes := extraStrings(cfg, "Scopes")
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+
+	return &OIDCProvider{
+		Name:   types.OIDC,
+		issuer: extraString(cfg, "Issuer"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       scopes,
+		},
+	}
+}
+
+// discover returns the issuer metadata, the config endpoints are set once it succeeded
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider != nil {
+		return p.provider, nil
+	}
+	if p.issuer == "" {
+		return nil, fmt.Errorf("oidc error: Issuer is required")
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc error: discovery of %s failed: %w", p.issuer, err)
+	}
+	p.config.Endpoint = provider.Endpoint()
+	p.provider = provider
+	return provider, nil
+}
+
+func (p *OIDCProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	if _, err := p.discover(ctx); err != nil {
+		return ""
+	}
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *OIDCProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if _, err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *OIDCProvider) DeviceAuth(ctx context.Context, opts ...oauth2.AuthCodeOption) (*oauth2.DeviceAuthResponse, error) {
+	if _, err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	if p.config.Endpoint.DeviceAuthURL == "" {
+		return nil, fmt.Errorf("oidc error: %s has no device_authorization_endpoint", p.issuer)
+	}
+	return p.config.DeviceAuth(ctx, opts...)
+}
+
+func (p *OIDCProvider) DeviceAccessToken(ctx context.Context, da *oauth2.DeviceAuthResponse, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if _, err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	return deviceAccessToken(ctx, p.config, da, opts...)
+}
+
+func (p *OIDCProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims OIDCClaims
+	// The id_token is only returned by the code exchange, tokens restored from storage may not have it
+	if idTokenStr, ok := token.Extra("id_token").(string); ok && idTokenStr != "" {
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, idTokenStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify oidc id_token: %w", err)
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, err
+		}
+	}
+
+	if provider.UserInfoEndpoint() != "" {
+		userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get oidc userinfo: %w", err)
+		}
+		if claims.Subject != "" && claims.Subject != userInfo.Subject {
+			return nil, fmt.Errorf("oidc userinfo sub %q does not match the id_token sub %q", userInfo.Subject, claims.Subject)
+		}
+		// The userinfo claims complete the id_token ones, which often only hold sub
+		if err := userInfo.Claims(&claims); err != nil {
+			return nil, err
+		}
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("oidc error: no id_token nor userinfo endpoint to identify the user")
+	}
+
+	email := claims.Email
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		email = ""
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: claims.Subject,
+		Email:          email,
+		Name:           selectFirst(claims.Name, claims.PreferredUsername),
+		AvatarURL:      claims.Picture,
+		Phone:          claims.PhoneNumber,
+		RawData:        claims,
+	}, nil
+}
@@ -10,7 +10,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 
@@ -21,17 +21,31 @@ import (
 //
 // **Key points**:
 // * After getting the `access_token`, an additional API call is required to get the `openid`.
-// * The `openid` response format is `callback( {"client_id":"...","openid":"..."} );`, which needs special handling.
-// * Similarly, `UnionID` is the key to synchronizing with the Tencent ecosystem.
+// * The token and `openid` endpoints answer `access_token=...` and `callback( {...} );` by default,
+//   `fmt=json` is passed to get plain JSON instead.
+// * `UnionID` is the key to synchronizing with the Tencent ecosystem, but it is only returned
+//   to apps with the unionid right, `Extra["UnionID"] = false` stops asking for it.
 
 type QQProvider struct {
-	Name   string
-	config *oauth2.Config
+	Name        string
+	config      *oauth2.Config
+	unionID     bool
+	subjectKind string
 }
 
+// NewQQProvider creates a new QQ Provider instance
+//
+// Extra fields: `UnionID` (ask for the unionid, true by default) and `SubjectID` (`openid` or `unionid`).
 func NewQQProvider(cfg *types.OauthConfig) types.Provider {
+	unionID := true
+	if _, ok := cfg.Extra["UnionID"]; ok {
+		unionID = extraBool(cfg, "UnionID")
+	}
+
 	return &QQProvider{
-		Name: types.QQ,
+		Name:        types.QQ,
+		unionID:     unionID,
+		subjectKind: extraString(cfg, "SubjectID"),
 		config: &oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
@@ -50,101 +64,82 @@ func (p *QQProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth
 }
 
 func (p *QQProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
-	// QQ's token response is text/plain, like access_token=...&expires_in=...
-	// The standard library's Exchange will fail, so a manual request is required.
-	// The standard oauth2.Config.Exchange method expects a JSON response.
-	// QQ's token endpoint returns a URL-encoded string.
-	// Therefore, we need to manually perform the exchange for QQ.
-	tokenURL := fmt.Sprintf(
-		"%s?grant_type=authorization_code&client_id=%s&client_secret=%s&code=%s&redirect_uri=%s",
-		p.config.Endpoint.TokenURL,
-		p.config.ClientID,
-		p.config.ClientSecret,
-		code,
-		url.QueryEscape(p.config.RedirectURL),
-	)
-
-	resp, err := http.Get(tokenURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
+	// QQ's token endpoint is a GET and returns a URL-encoded string unless fmt=json is set,
+	// so the standard oauth2.Config.Exchange can not be used.
+	query := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"fmt":           {"json"},
+	}
+
+	var tokenData struct {
+		AccessToken  string      `json:"access_token"`
+		ExpiresIn    json.Number `json:"expires_in"` // a string, e.g. "7776000"
+		RefreshToken string      `json:"refresh_token"`
+		qqError
+	}
+	if err := p.getJSON(ctx, p.config.Endpoint.TokenURL, query, &tokenData); err != nil {
 		return nil, err
 	}
-
-	values, err := url.ParseQuery(string(body))
-	if err != nil {
+	if err := tokenData.err("get access_token"); err != nil {
 		return nil, err
 	}
-	if values.Get("access_token") == "" {
-		return nil, fmt.Errorf("qq get access_token failed: %s", string(body))
+	if tokenData.AccessToken == "" {
+		return nil, fmt.Errorf("qq get access_token error: access_token not returned")
 	}
 
 	token := &oauth2.Token{
-		AccessToken:  values.Get("access_token"),
-		RefreshToken: values.Get("refresh_token"),
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+	}
+	if expiresIn, err := tokenData.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
 	}
 	return token, nil
 }
 
-// getOpenID is a QQ specific step
-func (p *QQProvider) getOpenID(accessToken string) (string, string, error) {
-	openidURL := fmt.Sprintf("https://graph.qq.com/oauth2.0/me?access_token=%s&unionid=1", accessToken)
-	resp, err := http.Get(openidURL)
-	if err != nil {
-		return "", "", err
+// getOpenID is a QQ specific step, the unionid is "" unless p.unionID is set
+func (p *QQProvider) getOpenID(ctx context.Context, accessToken string) (string, string, error) {
+	query := url.Values{
+		"access_token": {accessToken},
+		"fmt":          {"json"},
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", err
+	if p.unionID {
+		query.Set("unionid", "1")
 	}
 
-	// Response format: callback( {"client_id":"...","openid":"...","unionid":"..."} );
-	s := strings.Trim(string(body), "callback( );\n\r")
-
 	var data struct {
-		OpenID  string `json:"openid"`
-		UnionID string `json:"unionid"`
-		Error   int    `json:"error"`
-		Msg     string `json:"error_description"`
+		ClientID string `json:"client_id"`
+		OpenID   string `json:"openid"`
+		UnionID  string `json:"unionid"`
+		qqError
 	}
-	if err := json.Unmarshal([]byte(s), &data); err != nil {
+	if err := p.getJSON(ctx, "https://graph.qq.com/oauth2.0/me", query, &data); err != nil {
 		return "", "", err
 	}
-	if data.Error != 0 {
-		return "", "", fmt.Errorf("qq get openid error: %s", data.Msg)
+	if err := data.err("get openid"); err != nil {
+		return "", "", err
+	}
+	if data.OpenID == "" {
+		return "", "", fmt.Errorf("qq get openid error: openid not returned")
 	}
 
 	return data.OpenID, data.UnionID, nil
 }
 
 func (p *QQProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
-	openid, unionid, err := p.getOpenID(token.AccessToken)
-	if err != nil {
-		return nil, err
-	}
-
-	userInfoURL := fmt.Sprintf(
-		"https://graph.qq.com/user/get_user_info?access_token=%s&oauth_consumer_key=%s&openid=%s",
-		token.AccessToken,
-		p.config.ClientID,
-		openid,
-	)
-
-	resp, err := http.Get(userInfoURL)
+	openid, unionid, err := p.getOpenID(ctx, token.AccessToken)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	query := url.Values{
+		"access_token":       {token.AccessToken},
+		"oauth_consumer_key": {p.config.ClientID},
+		"openid":             {openid},
 	}
 
 	var qqUser struct {
@@ -154,26 +149,67 @@ func (p *QQProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*typ
 		Avatar     string `json:"figureurl_qq_2"` // 100x100
 		AvatarFull string `json:"figureurl_qq_1"` // 40x40
 	}
-
-	if err := json.Unmarshal(body, &qqUser); err != nil {
+	if err := p.getJSON(ctx, "https://graph.qq.com/user/get_user_info", query, &qqUser); err != nil {
 		return nil, err
 	}
 	if qqUser.Ret != 0 {
-		return nil, fmt.Errorf("qq get user info error: %s", qqUser.Msg)
+		return nil, fmt.Errorf("qq get user info error: %d %s", qqUser.Ret, qqUser.Msg)
 	}
 
-	// Prioritize using UnionID
-	providerUserID := unionid
-	if providerUserID == "" {
-		providerUserID = openid
+	// Prioritize using UnionID, unless the subject is configured
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  openid,
+		types.SubjectUnionID: unionid,
+	})
+	providerUserID, err := selectSubject("qq", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
 	}
 
 	return &types.UserInfo{
 		Provider:       p.Name,
 		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
 		Name:           qqUser.Nickname,
 		AvatarURL:      qqUser.Avatar,
 		Email:          "", // QQ does not provide email
 		RawData:        qqUser,
 	}, nil
 }
+
+// getJSON sends a GET request to endpoint with the escaped query and decodes the JSON response into out
+func (p *QQProvider) getJSON(ctx context.Context, endpoint string, query url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("qq error: unexpected response %q: %w", body, err)
+	}
+	return nil
+}
+
+// qqError is the error of the oauth2.0 endpoints, get_user_info uses `ret` and `msg` instead
+type qqError struct {
+	Error            int    `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (e qqError) err(action string) error {
+	if e.Error != 0 {
+		return fmt.Errorf("qq %s error: %d %s", action, e.Error, e.ErrorDescription)
+	}
+	return nil
+}
@@ -0,0 +1,540 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/credential"
+	"go.xiexianbin.cn/authkit/types"
+)
+
+const (
+	SAMLBindingRedirect = "redirect"
+	SAMLBindingPost     = "post"
+)
+
+// SAML 2.0 is not OAuth, the Web Browser SSO profile is mapped on the Provider interface as follows.
+//
+// **Key points**:
+// * The app is the service provider (SP): ClientID is its entity ID and RedirectURL its assertion consumer service (ACS),
+//   where the identity provider (IdP) posts the `SAMLResponse`. Metadata / ServeMetadata give the SP metadata to import in the IdP.
+// * The IdP metadata is imported from `Extra["IDPMetadata"]` (XML) or `Extra["IDPMetadataURL"]` (fetched on first use),
+//   `Extra["IDPEntityID"]` picks the IdP of a federation aggregate.
+// * SP-initiated: GetAuthURL returns the AuthnRequest with the HTTP-Redirect binding, with `Extra["Binding"] = "post"`
+//   GetAuthURL returns "" and AuthnRequestForm returns the auto-submitted HTTP-POST form instead.
+//   The request ID is kept in `Extra["Store"]` (a credential.Store) until a verified response comes back with the same RelayState.
+// * The posted form (`SAMLResponse` and `RelayState`) is passed url-encoded as the code to ExchangeCodeForToken,
+//   or as the credentials of VerifyCredentials: the provider is also a types.CredentialVerifier.
+// * IdP-initiated responses (without InResponseTo) are only accepted with `Extra["AllowIDPInitiated"]`.
+// * The IdP must sign either the Response, whose signature then covers the assertions it wraps, or every assertion
+//   of an unsigned Response (crewjam/saml rules). Encrypted assertions are decrypted with the SP `PrivateKey`,
+//   and each assertion ID is accepted once while it is valid (replay protection in the same Store).
+// * UserInfo: ProviderUserID is the NameID (or `Extra["SubjectAttribute"]`), email and name are read from the
+//   usual attributes of ADFS, Azure AD, Okta and Shibboleth unless `EmailAttribute` / `NameAttribute` are set.
+// ref: https://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf
+
+type SAMLProvider struct {
+	Name             string
+	binding          string
+	idpMetadataURL   string
+	idpEntityID      string
+	store            credential.Store
+	subjectAttribute string
+	emailAttribute   string
+	nameAttribute    string
+
+	// mu guards the lazy loading of the IdP metadata into sp
+	mu        sync.Mutex
+	sp        *saml.ServiceProvider
+	configErr error
+}
+
+// SAMLUser is the verified assertion of a SAML response, the RawData of the SAML UserInfo
+type SAMLUser struct {
+	Issuer       string              `json:"issuer"`
+	NameID       string              `json:"name_id"`
+	NameIDFormat string              `json:"name_id_format,omitempty"`
+	SessionIndex string              `json:"session_index,omitempty"`
+	Attributes   map[string][]string `json:"attributes"`
+}
+
+// Attribute returns the first value of the attribute name (or friendly name), or ""
+func (u *SAMLUser) Attribute(name string) string {
+	if values := u.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+var (
+	samlEmailAttributes = []string{
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"email",
+		"mail",
+	}
+	samlNameAttributes = []string{
+		"http://schemas.microsoft.com/identity/claims/displayname",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"displayName",
+		"name",
+		"cn",
+	}
+)
+
+// NewSAMLProvider creates a new SAML service provider, it is both a types.Provider and a types.CredentialVerifier
+//
+// Extra fields: `IDPMetadata` or `IDPMetadataURL`, `IDPEntityID`, `MetadataURL` (where the SP metadata is served),
+// `Certificate` and `PrivateKey` (PEM, sign the AuthnRequests and decrypt the assertions), `Binding` (`redirect` or `post`),
+// `NameIDFormat`, `AllowIDPInitiated`, `Store`, `SubjectAttribute`, `EmailAttribute` and `NameAttribute`.
+func NewSAMLProvider(cfg *types.OauthConfig) *SAMLProvider {
+	store, _ := cfg.Extra["Store"].(credential.Store)
+	if store == nil {
+		store = credential.NewMemoryStore()
+	}
+
+	binding := extraString(cfg, "Binding")
+	if binding == "" {
+		binding = SAMLBindingRedirect
+	}
+
+	p := &SAMLProvider{
+		Name:             types.SAML,
+		binding:          binding,
+		idpMetadataURL:   extraString(cfg, "IDPMetadataURL"),
+		idpEntityID:      extraString(cfg, "IDPEntityID"),
+		store:            store,
+		subjectAttribute: extraString(cfg, "SubjectAttribute"),
+		emailAttribute:   extraString(cfg, "EmailAttribute"),
+		nameAttribute:    extraString(cfg, "NameAttribute"),
+		sp: &saml.ServiceProvider{
+			EntityID:          cfg.ClientID,
+			HTTPClient:        http.DefaultClient,
+			AuthnNameIDFormat: saml.NameIDFormat(extraString(cfg, "NameIDFormat")),
+			AllowIDPInitiated: extraBool(cfg, "AllowIDPInitiated"),
+		},
+	}
+	if p.sp.AuthnNameIDFormat == "" {
+		p.sp.AuthnNameIDFormat = saml.UnspecifiedNameIDFormat
+	}
+
+	// Config errors are reported on the first call, as the constructor can not fail
+	acsURL, err := url.Parse(cfg.RedirectURL)
+	if err != nil {
+		p.configErr = fmt.Errorf("saml error: invalid RedirectURL: %w", err)
+		return p
+	}
+	p.sp.AcsURL = *acsURL
+	if metadataURL := extraString(cfg, "MetadataURL"); metadataURL != "" {
+		u, err := url.Parse(metadataURL)
+		if err != nil {
+			p.configErr = fmt.Errorf("saml error: invalid MetadataURL: %w", err)
+			return p
+		}
+		p.sp.MetadataURL = *u
+	}
+
+	if certificate, privateKey := extraString(cfg, "Certificate"), extraString(cfg, "PrivateKey"); certificate != "" || privateKey != "" {
+		p.sp.Certificate, p.sp.Key, p.configErr = parseSAMLKeyPair(certificate, privateKey)
+		if p.configErr != nil {
+			return p
+		}
+		p.sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+
+	if metadata := extraString(cfg, "IDPMetadata"); metadata != "" {
+		p.sp.IDPMetadata, p.configErr = parseSAMLMetadata([]byte(metadata), p.idpEntityID)
+	}
+	return p
+}
+
+// serviceProvider returns the SP, once the IdP metadata is loaded
+func (p *SAMLProvider) serviceProvider(ctx context.Context) (*saml.ServiceProvider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.configErr != nil {
+		return nil, p.configErr
+	}
+	if p.sp.IDPMetadata != nil {
+		return p.sp, nil
+	}
+	if p.idpMetadataURL == "" {
+		return nil, fmt.Errorf("saml error: IDPMetadata or IDPMetadataURL is required")
+	}
+
+	// A failed fetch is retried on the next call
+	req, err := http.NewRequestWithContext(ctx, "GET", p.idpMetadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("saml error: failed to fetch IdP metadata: %s", resp.Status)
+	}
+
+	p.sp.IDPMetadata, err = parseSAMLMetadata(body, p.idpEntityID)
+	if err != nil {
+		return nil, err
+	}
+	return p.sp, nil
+}
+
+// GetAuthURL returns the AuthnRequest URL of the HTTP-Redirect binding, or "" with the HTTP-POST binding (see AuthnRequestForm)
+func (p *SAMLProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	if p.binding != SAMLBindingRedirect {
+		return ""
+	}
+
+	sp, err := p.serviceProvider(ctx)
+	if err != nil {
+		return ""
+	}
+	req, err := p.authnRequest(ctx, sp, saml.HTTPRedirectBinding, state)
+	if err != nil {
+		return ""
+	}
+
+	// The RelayState is appended to the query as is
+	redirectURL, err := req.Redirect(url.QueryEscape(state), sp)
+	if err != nil {
+		return ""
+	}
+	return redirectURL.String()
+}
+
+// AuthnRequestForm returns the HTML form posting the AuthnRequest to the IdP (HTTP-POST binding), it submits itself on load
+func (p *SAMLProvider) AuthnRequestForm(ctx context.Context, state string) ([]byte, error) {
+	sp, err := p.serviceProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := p.authnRequest(ctx, sp, saml.HTTPPostBinding, state)
+	if err != nil {
+		return nil, err
+	}
+	return req.Post(state), nil
+}
+
+// authnRequest creates an AuthnRequest and keeps its ID until the response, bound to the RelayState
+func (p *SAMLProvider) authnRequest(ctx context.Context, sp *saml.ServiceProvider, binding, state string) (*saml.AuthnRequest, error) {
+	location := sp.GetSSOBindingLocation(binding)
+	if location == "" {
+		return nil, fmt.Errorf("saml error: the IdP has no SingleSignOnService for %s", binding)
+	}
+
+	req, err := sp.MakeAuthenticationRequest(location, binding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.store.Set(ctx, samlRequestKey(req.ID), &credential.Token{
+		Value:     state,
+		ExpiresAt: time.Now().Add(saml.MaxIssueDelay),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ExchangeCodeForToken verifies a SAML response, code is the url-encoded form posted to the ACS (`SAMLResponse` and `RelayState`)
+func (p *SAMLProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	form, err := url.ParseQuery(code)
+	if err != nil {
+		return nil, fmt.Errorf("saml error: invalid form: %w", err)
+	}
+	responseXML, err := base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+	if err != nil || len(responseXML) == 0 {
+		return nil, fmt.Errorf("saml error: SAMLResponse is missing or invalid")
+	}
+	relayState := form.Get("RelayState")
+
+	sp, err := p.serviceProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The verification needs the possible request IDs, the unverified InResponseTo is only trusted once the signature is checked
+	var unverified struct {
+		InResponseTo string `xml:",attr"`
+	}
+	if err := xml.Unmarshal(responseXML, &unverified); err != nil {
+		return nil, fmt.Errorf("saml error: invalid SAMLResponse: %w", err)
+	}
+	requestID := unverified.InResponseTo
+
+	var possibleRequestIDs []string
+	if requestID != "" {
+		possibleRequestIDs = []string{requestID}
+	} else if !sp.AllowIDPInitiated {
+		return nil, fmt.Errorf("saml error: IdP-initiated login is not allowed")
+	}
+
+	assertion, err := sp.ParseXMLResponse(responseXML, possibleRequestIDs, sp.AcsURL)
+	if err != nil {
+		// The error message of crewjam/saml is static, the cause is kept private
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) && invalid.PrivateErr != nil {
+			return nil, fmt.Errorf("saml error: invalid response: %w", invalid.PrivateErr)
+		}
+		return nil, fmt.Errorf("saml error: %w", err)
+	}
+
+	// The AuthnRequest is consumed atomically, so that concurrent submissions of a response are accepted once
+	if requestID != "" {
+		request, err := p.store.GetAndDelete(ctx, samlRequestKey(requestID))
+		if err != nil {
+			return nil, err
+		}
+		if request == nil || time.Now().After(request.ExpiresAt) {
+			return nil, fmt.Errorf("saml error: AuthnRequest %s is unknown, expired or already used", requestID)
+		}
+		if request.Value != relayState {
+			return nil, fmt.Errorf("saml error: RelayState does not match the AuthnRequest")
+		}
+	}
+
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return nil, fmt.Errorf("saml error: assertion has no NameID")
+	}
+
+	if err := p.checkReplay(ctx, assertion); err != nil {
+		return nil, err
+	}
+
+	samlUser := &SAMLUser{
+		Issuer:       assertion.Issuer.Value,
+		NameID:       strings.TrimSpace(assertion.Subject.NameID.Value),
+		NameIDFormat: assertion.Subject.NameID.Format,
+		Attributes:   make(map[string][]string),
+	}
+	token := &oauth2.Token{AccessToken: assertion.ID, TokenType: "saml"}
+	for _, statement := range assertion.AuthnStatements {
+		samlUser.SessionIndex = statement.SessionIndex
+		if statement.SessionNotOnOrAfter != nil {
+			token.Expiry = *statement.SessionNotOnOrAfter
+		}
+	}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			values := make([]string, 0, len(attribute.Values))
+			for _, value := range attribute.Values {
+				values = append(values, strings.TrimSpace(value.Value))
+			}
+			samlUser.Attributes[attribute.Name] = append(samlUser.Attributes[attribute.Name], values...)
+			// Shibboleth sends urn:oid names, their friendly names are easier to configure
+			if friendlyName := attribute.FriendlyName; friendlyName != "" && friendlyName != attribute.Name {
+				if _, exists := samlUser.Attributes[friendlyName]; !exists {
+					samlUser.Attributes[friendlyName] = values
+				}
+			}
+		}
+	}
+
+	return token.WithExtra(map[string]interface{}{
+		"saml_user":   samlUser,
+		"relay_state": relayState,
+	}), nil
+}
+
+// checkReplay accepts each assertion ID once, until the assertion expires
+func (p *SAMLProvider) checkReplay(ctx context.Context, assertion *saml.Assertion) error {
+	if assertion.ID == "" {
+		return fmt.Errorf("saml error: assertion has no ID")
+	}
+
+	expiresAt := assertion.IssueInstant.Add(saml.MaxIssueDelay)
+	if assertion.Conditions != nil && assertion.Conditions.NotOnOrAfter.After(expiresAt) {
+		expiresAt = assertion.Conditions.NotOnOrAfter
+	}
+	stored, err := p.store.SetIfAbsent(ctx, samlAssertionKey(assertion.ID), &credential.Token{
+		Value:     assertion.Issuer.Value,
+		ExpiresAt: expiresAt.Add(saml.MaxClockSkew),
+	})
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return fmt.Errorf("saml error: assertion %s was already used", assertion.ID)
+	}
+	return nil
+}
+
+func (p *SAMLProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	samlUser, ok := token.Extra("saml_user").(*SAMLUser)
+	if !ok || samlUser == nil {
+		return nil, fmt.Errorf("saml user not found in token")
+	}
+
+	subject := samlUser.NameID
+	if p.subjectAttribute != "" {
+		subject = samlUser.Attribute(p.subjectAttribute)
+		if subject == "" {
+			return nil, fmt.Errorf("saml error: attribute %s is missing", p.subjectAttribute)
+		}
+	}
+
+	userInfo := &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: subject,
+		Email:          samlUser.firstAttribute(p.emailAttribute, samlEmailAttributes),
+		Name:           samlUser.firstAttribute(p.nameAttribute, samlNameAttributes),
+		RawData:        samlUser,
+	}
+	if userInfo.Email == "" && samlUser.NameIDFormat == string(saml.EmailAddressNameIDFormat) {
+		userInfo.Email = samlUser.NameID
+	}
+	return userInfo, nil
+}
+
+// firstAttribute returns the configured attribute, or the first of the defaults sent by the IdP
+func (u *SAMLUser) firstAttribute(configured string, defaults []string) string {
+	if configured != "" {
+		return u.Attribute(configured)
+	}
+	for _, name := range defaults {
+		if value := u.Attribute(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// VerifyCredentials verifies the form posted by the IdP to the ACS, SP-initiated or IdP-initiated
+func (p *SAMLProvider) VerifyCredentials(ctx context.Context, credentials url.Values) (*types.UserInfo, error) {
+	token, err := p.ExchangeCodeForToken(ctx, credentials.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return p.GetUserInfo(ctx, token)
+}
+
+// Metadata returns the SP metadata, to import in the IdP
+func (p *SAMLProvider) Metadata() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.configErr != nil {
+		return nil, p.configErr
+	}
+
+	metadata, err := xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), metadata...), nil
+}
+
+// ServeMetadata is the http.Handler of `Extra["MetadataURL"]`
+func (p *SAMLProvider) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := p.Metadata()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+func samlRequestKey(requestID string) string {
+	return "saml:request:" + requestID
+}
+
+func samlAssertionKey(assertionID string) string {
+	return "saml:assertion:" + assertionID
+}
+
+// parseSAMLMetadata parses an IdP EntityDescriptor, or picks it from an EntitiesDescriptor (e.g. a federation aggregate)
+func parseSAMLMetadata(data []byte, entityID string) (*saml.EntityDescriptor, error) {
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &entity); err == nil {
+		if entityID != "" && entity.EntityID != entityID {
+			return nil, fmt.Errorf("saml error: IdP metadata is for %s, not %s", entity.EntityID, entityID)
+		}
+		return &entity, nil
+	}
+
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, fmt.Errorf("saml error: invalid IdP metadata: %w", err)
+	}
+	if found := findSAMLEntity(&entities, entityID); found != nil {
+		return found, nil
+	}
+	return nil, fmt.Errorf("saml error: IdP %q not found in metadata", entityID)
+}
+
+func findSAMLEntity(entities *saml.EntitiesDescriptor, entityID string) *saml.EntityDescriptor {
+	for i := range entities.EntityDescriptors {
+		entity := &entities.EntityDescriptors[i]
+		if len(entity.IDPSSODescriptors) > 0 && (entityID == "" || entity.EntityID == entityID) {
+			return entity
+		}
+	}
+	for i := range entities.EntitiesDescriptors {
+		if found := findSAMLEntity(&entities.EntitiesDescriptors[i], entityID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// parseSAMLKeyPair parses the PEM certificate and private key of the SP
+func parseSAMLKeyPair(certificatePEM, privateKeyPEM string) (*x509.Certificate, crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return nil, nil, fmt.Errorf("saml error: invalid Certificate PEM")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("saml error: invalid Certificate: %w", err)
+	}
+
+	block, _ = pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, nil, fmt.Errorf("saml error: invalid PrivateKey PEM")
+	}
+	var key any
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, nil, fmt.Errorf("saml error: invalid PrivateKey: %w", err)
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("saml error: unsupported PrivateKey type %T", key)
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(certificate.PublicKey) {
+		return nil, nil, fmt.Errorf("saml error: PrivateKey does not match Certificate")
+	}
+	return certificate, signer, nil
+}
@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// newTestCertificate returns a self-signed certificate of commonName, valid for the loopback addresses
+func newTestCertificate(t *testing.T, commonName string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+// samlIDP is a self-signed identity provider issuing the responses of crewjam/saml to a single SP
+type samlIDP struct {
+	*saml.IdentityProvider
+	spMetadata *saml.EntityDescriptor
+}
+
+func newSAMLIDP(t *testing.T) *samlIDP {
+	certificate, key := newTestCertificate(t, "idp.example.org")
+	idp := &samlIDP{IdentityProvider: &saml.IdentityProvider{
+		Key:         key,
+		Certificate: certificate,
+		MetadataURL: url.URL{Scheme: "https", Host: "idp.example.org", Path: "/saml/metadata"},
+		SSOURL:      url.URL{Scheme: "https", Host: "idp.example.org", Path: "/saml/sso"},
+	}}
+	idp.ServiceProviderProvider = idp
+	return idp
+}
+
+func (idp *samlIDP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	return idp.spMetadata, nil
+}
+
+// newTestSAMLProvider creates an SP trusting idp, and registers its metadata in idp
+func newTestSAMLProvider(t *testing.T, idp *samlIDP, extra map[string]any) *SAMLProvider {
+	t.Helper()
+	metadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra == nil {
+		extra = map[string]any{}
+	}
+	extra["IDPMetadata"] = string(metadata)
+	p := NewSAMLProvider(&types.OauthConfig{
+		ClientID:    "https://sp.example.org/saml/metadata",
+		RedirectURL: "https://sp.example.org/saml/acs",
+		Extra:       extra,
+	})
+	if p.configErr != nil {
+		t.Fatal(p.configErr)
+	}
+	idp.spMetadata = p.sp.Metadata()
+	return p
+}
+
+var samlAlice = &saml.Session{
+	ID:             "session-1",
+	NameID:         "alice@example.org",
+	NameIDFormat:   string(saml.EmailAddressNameIDFormat),
+	UserName:       "alice",
+	UserEmail:      "alice@example.org",
+	UserCommonName: "Alice Liddell",
+	Groups:         []string{"staff"},
+}
+
+// respond answers the AuthnRequest of authURL, or sends an IdP-initiated response to the SP when authURL is "",
+// it returns the form posted to the ACS
+func (idp *samlIDP) respond(t *testing.T, authURL string, session *saml.Session) url.Values {
+	t.Helper()
+	if authURL == "" {
+		return idp.respondTo(t, "", session)
+	}
+	req, err := saml.NewIdpAuthnRequest(idp.IdentityProvider, httptest.NewRequest("GET", authURL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return idp.post(t, req, session)
+}
+
+// respondTo sends a response to the AuthnRequest requestID, whether the SP issued it or not
+func (idp *samlIDP) respondTo(t *testing.T, requestID string, session *saml.Session) url.Values {
+	t.Helper()
+	return idp.post(t, &saml.IdpAuthnRequest{
+		IDP:                     idp.IdentityProvider,
+		HTTPRequest:             httptest.NewRequest("POST", idp.SSOURL.String(), nil),
+		Request:                 saml.AuthnRequest{ID: requestID},
+		ServiceProviderMetadata: idp.spMetadata,
+		SPSSODescriptor:         &idp.spMetadata.SPSSODescriptors[0],
+		ACSEndpoint:             &idp.spMetadata.SPSSODescriptors[0].AssertionConsumerServices[0],
+		Now:                     saml.TimeNow(),
+	}, session)
+}
+
+// post signs the response of req, it returns the form posted to the ACS
+func (idp *samlIDP) post(t *testing.T, req *saml.IdpAuthnRequest, session *saml.Session) url.Values {
+	t.Helper()
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		t.Fatal(err)
+	}
+	form, err := req.PostBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.Values{"SAMLResponse": {form.SAMLResponse}, "RelayState": {form.RelayState}}
+}
+
+func mustDecodeSAMLResponse(t *testing.T, form url.Values) []byte {
+	t.Helper()
+	response, err := base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// editSAMLResponse rewrites the XML of the SAMLResponse of form
+func editSAMLResponse(t *testing.T, form url.Values, edit func(response string) string) url.Values {
+	t.Helper()
+	response := mustDecodeSAMLResponse(t, form)
+	edited := edit(string(response))
+	if edited == string(response) {
+		t.Fatal("SAMLResponse left unchanged")
+	}
+	return url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(edited))}, "RelayState": {form.Get("RelayState")}}
+}
+
+func TestSAMLSignedResponse(t *testing.T) {
+	idp := newSAMLIDP(t)
+	p := newTestSAMLProvider(t, idp, nil)
+	ctx := context.Background()
+
+	authURL := p.GetAuthURL(ctx, "state-1")
+	if !strings.HasPrefix(authURL, "https://idp.example.org/saml/sso?SAMLRequest=") {
+		t.Fatalf("unexpected AuthnRequest URL %s", authURL)
+	}
+	token, err := p.ExchangeCodeForToken(ctx, idp.respond(t, authURL, samlAlice).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayState := token.Extra("relay_state"); relayState != "state-1" {
+		t.Fatalf("relay_state = %v, want state-1", relayState)
+	}
+
+	userInfo, err := p.GetUserInfo(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.ProviderUserID != "alice@example.org" || userInfo.Email != "alice@example.org" || userInfo.Name != "Alice Liddell" {
+		t.Fatalf("unexpected user %+v", userInfo)
+	}
+	samlUser := userInfo.RawData.(*SAMLUser)
+	if samlUser.Issuer != "https://idp.example.org/saml/metadata" || samlUser.Attribute("eduPersonAffiliation") != "staff" {
+		t.Fatalf("unexpected SAML user %+v", samlUser)
+	}
+}
+
+func TestSAMLAttributeMapping(t *testing.T) {
+	idp := newSAMLIDP(t)
+	p := newTestSAMLProvider(t, idp, map[string]any{
+		"SubjectAttribute": "uid",
+		"EmailAttribute":   "eduPersonPrincipalName",
+		"NameAttribute":    "urn:oid:2.5.4.3",
+	})
+	ctx := context.Background()
+
+	userInfo, err := p.VerifyCredentials(ctx, idp.respond(t, p.GetAuthURL(ctx, "state-1"), samlAlice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.ProviderUserID != "alice" || userInfo.Email != "alice@example.org" || userInfo.Name != "Alice Liddell" {
+		t.Fatalf("unexpected user %+v", userInfo)
+	}
+
+	// A missing subject attribute is an error, the NameID is not used instead
+	p = newTestSAMLProvider(t, idp, map[string]any{"SubjectAttribute": "employeeNumber"})
+	if _, err := p.VerifyCredentials(ctx, idp.respond(t, p.GetAuthURL(ctx, "state-1"), samlAlice)); err == nil || !strings.Contains(err.Error(), "employeeNumber") {
+		t.Fatalf("err = %v, want the missing attribute", err)
+	}
+}
+
+func TestSAMLEncryptedAssertion(t *testing.T) {
+	certificate, key := newTestCertificate(t, "sp.example.org")
+	idp := newSAMLIDP(t)
+	p := newTestSAMLProvider(t, idp, map[string]any{
+		"Certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})),
+		"PrivateKey":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+	})
+	ctx := context.Background()
+
+	// The IdP encrypts the assertions to the certificate of the SP metadata
+	form := idp.respond(t, p.GetAuthURL(ctx, "state-1"), samlAlice)
+	response := mustDecodeSAMLResponse(t, form)
+	if !strings.Contains(string(response), "EncryptedAssertion") || strings.Contains(string(response), "alice@example.org") {
+		t.Fatal("the assertion is not encrypted")
+	}
+
+	userInfo, err := p.VerifyCredentials(ctx, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.ProviderUserID != "alice@example.org" {
+		t.Fatalf("unexpected user %+v", userInfo)
+	}
+}
+
+func TestSAMLInvalidSignature(t *testing.T) {
+	idp := newSAMLIDP(t)
+	p := newTestSAMLProvider(t, idp, nil)
+	ctx := context.Background()
+
+	form := idp.respond(t, p.GetAuthURL(ctx, "state-1"), samlAlice)
+	impostor := newSAMLIDP(t)
+	impostor.spMetadata = idp.spMetadata
+	signatures := regexp.MustCompile(`<ds:Signature\b[\s\S]*?</ds:Signature>`)
+	tests := []struct {
+		name string
+		form url.Values
+	}{
+		{name: "tampered", form: editSAMLResponse(t, form, func(response string) string {
+			return strings.ReplaceAll(response, "alice@example.org", "mallory@example.org")
+		})},
+		{name: "unsigned", form: editSAMLResponse(t, form, func(response string) string {
+			return signatures.ReplaceAllString(response, "")
+		})},
+		{name: "signed by another IdP", form: impostor.respond(t, p.GetAuthURL(ctx, "state-1"), samlAlice)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.VerifyCredentials(ctx, tt.form); err == nil || !strings.Contains(err.Error(), "signature") {
+				t.Fatalf("err = %v, want a signature error", err)
+			}
+		})
+	}
+
+	// The forged responses did not consume the pending AuthnRequest
+	if _, err := p.VerifyCredentials(ctx, form); err != nil {
+		t.Fatalf("genuine response rejected: %v", err)
+	}
+}
+
+func TestSAMLInResponseTo(t *testing.T) {
+	idp := newSAMLIDP(t)
+	p := newTestSAMLProvider(t, idp, nil)
+	ctx := context.Background()
+
+	// A signed response to an AuthnRequest the SP did not issue
+	p.GetAuthURL(ctx, "state-1")
+	if _, err := p.VerifyCredentials(ctx, idp.respondTo(t, "id-unknown", samlAlice)); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Fatalf("err = %v, want an unknown AuthnRequest", err)
+	}
+
+	// A response whose InResponseTo was rewritten to the pending AuthnRequest, breaking the signature
+	authURL := p.GetAuthURL(ctx, "state-1")
+	pending := regexp.MustCompile(`InResponseTo="[^"]*"`).FindString(string(mustDecodeSAMLResponse(t, idp.respond(t, authURL, samlAlice))))
+	rewritten := editSAMLResponse(t, idp.respondTo(t, "id-other", samlAlice), func(response string) string {
+		return strings.ReplaceAll(response, `InResponseTo="id-other"`, pending)
+	})
+	if _, err := p.VerifyCredentials(ctx, rewritten); err == nil {
+		t.Fatal("response with a rewritten InResponseTo accepted")
+	}
+
+	// A RelayState which is not the one of the AuthnRequest
+	form := idp.respond(t, p.GetAuthURL(ctx, "state-2"), samlAlice)
+	form.Set("RelayState", "state-3")
+	if _, err := p.VerifyCredentials(ctx, form); err == nil || !strings.Contains(err.Error(), "RelayState") {
+		t.Fatalf("err = %v, want a RelayState mismatch", err)
+	}
+
+	// IdP-initiated responses have no InResponseTo
+	if _, err := p.VerifyCredentials(ctx, idp.respond(t, "", samlAlice)); err == nil || !strings.Contains(err.Error(), "IdP-initiated") {
+		t.Fatalf("err = %v, want IdP-initiated login refused", err)
+	}
+	p = newTestSAMLProvider(t, idp, map[string]any{"AllowIDPInitiated": true})
+	if _, err := p.VerifyCredentials(ctx, idp.respond(t, "", samlAlice)); err != nil {
+		t.Fatalf("IdP-initiated login with AllowIDPInitiated: %v", err)
+	}
+}
+
+func TestSAMLReplay(t *testing.T) {
+	idp := newSAMLIDP(t)
+	p := newTestSAMLProvider(t, idp, map[string]any{"AllowIDPInitiated": true})
+	ctx := context.Background()
+
+	// The AuthnRequest is consumed by the first response
+	form := idp.respond(t, p.GetAuthURL(ctx, "state-1"), samlAlice)
+	if _, err := p.VerifyCredentials(ctx, form); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyCredentials(ctx, form); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("err = %v, want the AuthnRequest already used", err)
+	}
+
+	// The assertion of an IdP-initiated response is accepted once
+	form = idp.respond(t, "", samlAlice)
+	if _, err := p.VerifyCredentials(ctx, form); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyCredentials(ctx, form); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("err = %v, want the assertion already used", err)
+	}
+}
+
+func TestSAMLConcurrentSubmissions(t *testing.T) {
+	idp := newSAMLIDP(t)
+	ctx := context.Background()
+
+	for _, allowIDPInitiated := range []bool{false, true} {
+		p := newTestSAMLProvider(t, idp, map[string]any{"AllowIDPInitiated": allowIDPInitiated})
+		authURL := ""
+		if !allowIDPInitiated {
+			authURL = p.GetAuthURL(ctx, "state-1")
+		}
+		form := idp.respond(t, authURL, samlAlice)
+
+		const n = 20
+		var wg sync.WaitGroup
+		var accepted atomic.Int32
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := p.VerifyCredentials(ctx, form); err == nil {
+					accepted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := accepted.Load(); got != 1 {
+			t.Fatalf("AllowIDPInitiated=%v: response accepted %d times, want 1", allowIDPInitiated, got)
+		}
+	}
+}
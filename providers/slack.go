@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Slack login uses "Sign in with Slack", an OpenID Connect flow.
+//
+// **Key points**:
+// * The `openid profile email` scopes return an id_token, verified against https://slack.com.
+// * The workspace is returned in the `https://slack.com/team_id` claim and surfaced as `UserInfo.TenantID`.
+// * `Extra["TeamIDs"]` restricts the login to some workspaces, with a single one it is preselected by the `team` param.
+// * Slack user IDs are unique per workspace, the subject is `<team_id>:<sub>` and the bare user ID is the `user_id` alternate ID.
+
+const slackIssuer = "https://slack.com"
+
+type SlackProvider struct {
+	Name    string
+	config  *oauth2.Config
+	teamIDs []string
+}
+
+// SlackUser is the RawData of the Slack UserInfo
+type SlackUser struct {
+	Sub           string `json:"sub"`
+	UserID        string `json:"https://slack.com/user_id"`
+	TeamID        string `json:"https://slack.com/team_id"`
+	TeamName      string `json:"https://slack.com/team_name"`
+	TeamDomain    string `json:"https://slack.com/team_domain"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	Locale        string `json:"locale"`
+}
+
+// NewSlackProvider creates a new Slack Provider instance
+//
+// Extra fields: `TeamIDs` (the workspaces allowed to sign in).
+func NewSlackProvider(cfg *types.OauthConfig) types.Provider {
+	return &SlackProvider{
+		Name:    types.SLACK,
+		teamIDs: extraStrings(cfg, "TeamIDs"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   "https://slack.com/openid/connect/authorize",
+				TokenURL:  "https://slack.com/api/openid.connect.token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+	}
+}
+
+func (p *SlackProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	if len(p.teamIDs) == 1 {
+		// Skip the workspace picker
+		opts = append(opts, oauth2.SetAuthURLParam("team", p.teamIDs[0]))
+	}
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *SlackProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return p.config.Exchange(ctx, code, opts...)
+}
+
+func (p *SlackProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	var slackUser SlackUser
+
+	// The id_token is only returned by the code exchange, otherwise the userInfo API is called
+	if idTokenStr, ok := token.Extra("id_token").(string); ok && idTokenStr != "" {
+		provider, err := oidc.NewProvider(ctx, slackIssuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get slack oidc provider: %w", err)
+		}
+
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, idTokenStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify slack id_token: %w", err)
+		}
+		if err := idToken.Claims(&slackUser); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal slack id_token claims: %w", err)
+		}
+	} else if err := p.userInfo(ctx, token, &slackUser); err != nil {
+		return nil, err
+	}
+
+	if slackUser.Sub == "" || slackUser.TeamID == "" {
+		return nil, fmt.Errorf("slack error: sub or team_id not returned")
+	}
+	if len(p.teamIDs) > 0 && !slices.Contains(p.teamIDs, slackUser.TeamID) {
+		return nil, fmt.Errorf("slack workspace %s is not allowed", slackUser.TeamID)
+	}
+
+	email := ""
+	if slackUser.EmailVerified {
+		email = slackUser.Email
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: tenantScopedID(slackUser.TeamID, slackUser.Sub),
+		AlternateIDs:   compactIDs(map[string]string{types.SubjectUserID: selectFirst(slackUser.UserID, slackUser.Sub)}),
+		TenantID:       slackUser.TeamID,
+		Email:          email,
+		Name:           slackUser.Name,
+		AvatarURL:      slackUser.Picture,
+		RawData:        slackUser,
+	}, nil
+}
+
+// userInfo calls the `openid.connect.userInfo` API, which answers 200 with `ok: false` on errors
+func (p *SlackProvider) userInfo(ctx context.Context, token *oauth2.Token, out *SlackUser) error {
+	client := p.config.Client(ctx, token)
+	resp, err := client.Get("https://slack.com/api/openid.connect.userInfo")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if !status.OK {
+		return fmt.Errorf("slack error: %s", status.Error)
+	}
+	return json.Unmarshal(body, out)
+}
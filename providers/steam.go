@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Steam only supports OpenID 2.0, which is mapped on the Provider interface as follows.
+//
+// **Key points**:
+// * GetAuthURL builds the `checkid_setup` redirect, the state is added to `openid.return_to` (the RedirectURL)
+//   and comes back as a query param of the callback.
+// * There is no code: the raw query string of the callback request is passed as the code to ExchangeCodeForToken,
+//   which checks `openid.return_to` and `openid.claimed_id` and verifies the assertion with `check_authentication`.
+// * The token has no access token, the SteamID64 is stored in its Extra (see SteamID).
+// * The persona name and avatar are fetched with the Web API key of `Extra["APIKey"]`, if any.
+
+const (
+	steamOpenIDEndpoint = "https://steamcommunity.com/openid/login"
+	steamOpenIDNS       = "http://specs.openid.net/auth/2.0"
+	steamIdentifier     = "http://specs.openid.net/auth/2.0/identifier_select"
+)
+
+// steamClaimedIDPattern matches the claimed ID of a Steam user and captures the SteamID64
+var steamClaimedIDPattern = regexp.MustCompile(`^https?://steamcommunity\.com/openid/id/(\d{17})$`)
+
+type SteamProvider struct {
+	Name        string
+	redirectURL string
+	apiKey      string
+}
+
+// NewSteamProvider creates a new Steam Provider instance, only the RedirectURL is used from the OAuth config
+//
+// Extra fields: `APIKey` (Steam Web API key, to fetch the persona name and avatar).
+func NewSteamProvider(cfg *types.OauthConfig) types.Provider {
+	return &SteamProvider{
+		Name:        types.STEAM,
+		redirectURL: cfg.RedirectURL,
+		apiKey:      extraString(cfg, "APIKey"),
+	}
+}
+
+func (p *SteamProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	returnTo, err := url.Parse(p.redirectURL)
+	if err != nil {
+		return ""
+	}
+	query := returnTo.Query()
+	query.Set("state", state)
+	returnTo.RawQuery = query.Encode()
+
+	params := url.Values{
+		"openid.ns":         {steamOpenIDNS},
+		"openid.mode":       {"checkid_setup"},
+		"openid.return_to":  {returnTo.String()},
+		"openid.realm":      {returnTo.Scheme + "://" + returnTo.Host},
+		"openid.identity":   {steamIdentifier},
+		"openid.claimed_id": {steamIdentifier},
+	}
+	return steamOpenIDEndpoint + "?" + params.Encode()
+}
+
+// ExchangeCodeForToken verifies the OpenID assertion, code is the raw query string of the callback request
+func (p *SteamProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	params, err := url.ParseQuery(code)
+	if err != nil {
+		return nil, fmt.Errorf("steam error: invalid callback query: %w", err)
+	}
+
+	if params.Get("openid.mode") != "id_res" {
+		return nil, fmt.Errorf("steam error: unexpected openid.mode %q", params.Get("openid.mode"))
+	}
+	if params.Get("openid.op_endpoint") != steamOpenIDEndpoint {
+		return nil, fmt.Errorf("steam error: unexpected openid.op_endpoint %q", params.Get("openid.op_endpoint"))
+	}
+	if err := p.checkReturnTo(params.Get("openid.return_to"), params.Get("state")); err != nil {
+		return nil, err
+	}
+
+	claimedID := params.Get("openid.claimed_id")
+	if claimedID != params.Get("openid.identity") {
+		return nil, fmt.Errorf("steam error: openid.claimed_id does not match openid.identity")
+	}
+	match := steamClaimedIDPattern.FindStringSubmatch(claimedID)
+	if match == nil {
+		return nil, fmt.Errorf("steam error: invalid openid.claimed_id %q", claimedID)
+	}
+
+	if err := p.checkAuthentication(ctx, params); err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{}
+	return token.WithExtra(map[string]interface{}{
+		"steamid": match[1],
+	}), nil
+}
+
+// checkReturnTo checks that the assertion was issued for the RedirectURL and the state of the callback
+func (p *SteamProvider) checkReturnTo(returnTo, state string) error {
+	expected, err := url.Parse(p.redirectURL)
+	if err != nil {
+		return err
+	}
+	actual, err := url.Parse(returnTo)
+	if err != nil {
+		return fmt.Errorf("steam error: invalid openid.return_to: %w", err)
+	}
+	if actual.Scheme != expected.Scheme || actual.Host != expected.Host || actual.Path != expected.Path {
+		return fmt.Errorf("steam error: openid.return_to %q does not match the redirect URL", returnTo)
+	}
+	if actual.Query().Get("state") != state {
+		return fmt.Errorf("steam error: openid.return_to state does not match the callback state")
+	}
+	return nil
+}
+
+// checkAuthentication asks Steam to verify the signature of the assertion
+func (p *SteamProvider) checkAuthentication(ctx context.Context, params url.Values) error {
+	values := url.Values{}
+	for key, value := range params {
+		if strings.HasPrefix(key, "openid.") {
+			values[key] = value
+		}
+	}
+	values.Set("openid.mode", "check_authentication")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", steamOpenIDEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// The response is a key-value form: "ns:http://specs.openid.net/auth/2.0\nis_valid:true\n"
+	for _, line := range strings.Split(string(body), "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && key == "is_valid" {
+			if value == "true" {
+				return nil
+			}
+			break
+		}
+	}
+	return fmt.Errorf("steam error: the openid assertion is not valid")
+}
+
+func (p *SteamProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	steamID := SteamID(token)
+	if steamID == "" {
+		return nil, fmt.Errorf("steamid not found in token")
+	}
+
+	userInfo := &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: steamID,
+		RawData:        map[string]string{"steamid": steamID},
+	}
+	if p.apiKey == "" {
+		return userInfo, nil
+	}
+
+	summaryURL := fmt.Sprintf(
+		"https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v2/?key=%s&steamids=%s",
+		url.QueryEscape(p.apiKey),
+		url.QueryEscape(steamID),
+	)
+	req, err := http.NewRequestWithContext(ctx, "GET", summaryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("steam web api error: %s", resp.Status)
+	}
+
+	var summaries struct {
+		Response struct {
+			Players []struct {
+				SteamID     string `json:"steamid"`
+				PersonaName string `json:"personaname"`
+				ProfileURL  string `json:"profileurl"`
+				Avatar      string `json:"avatar"`
+				AvatarFull  string `json:"avatarfull"`
+				RealName    string `json:"realname"`
+			} `json:"players"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(body, &summaries); err != nil {
+		return nil, err
+	}
+	if len(summaries.Response.Players) == 0 {
+		return nil, fmt.Errorf("steam web api error: player %s not found", steamID)
+	}
+
+	player := summaries.Response.Players[0]
+	userInfo.Name = player.PersonaName
+	userInfo.AvatarURL = player.AvatarFull
+	userInfo.RawData = player
+	return userInfo, nil
+}
+
+// SteamID returns the SteamID64 stored in a token returned by SteamProvider.ExchangeCodeForToken, or "" if there is none
+func SteamID(token *oauth2.Token) string {
+	if token == nil {
+		return ""
+	}
+	steamID, _ := token.Extra("steamid").(string)
+	return steamID
+}
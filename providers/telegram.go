@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Telegram Login Widget is not OAuth, the widget hands the signed user data to the website.
+//
+// **Key points**:
+// * The widget posts (or redirects with) `id`, `first_name`, `last_name`, `username`, `photo_url`, `auth_date` and `hash`.
+// * `hash` is the hex HMAC-SHA256 of the sorted `key=value` lines of the other fields, keyed by SHA256(bot token).
+// * `auth_date` must be recent, `Extra["MaxAge"]` (1 hour by default) limits the replay of intercepted data.
+// * It implements types.CredentialVerifier instead of types.Provider.
+
+// defaultTelegramMaxAge is how old the `auth_date` may be, unless `Extra["MaxAge"]` is set
+const defaultTelegramMaxAge = time.Hour
+
+type TelegramProvider struct {
+	Name     string
+	botToken string
+	maxAge   time.Duration
+}
+
+// TelegramUser is the RawData of the Telegram UserInfo
+type TelegramUser struct {
+	ID        string `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+	PhotoURL  string `json:"photo_url"`
+	AuthDate  int64  `json:"auth_date"`
+}
+
+// NewTelegramProvider creates a new Telegram Login Widget verifier, the ClientSecret is the bot token
+// (the ClientID, the bot username, is only needed by the widget)
+//
+// Extra fields: `MaxAge` (how old the `auth_date` may be, 1 hour by default).
+func NewTelegramProvider(cfg *types.OauthConfig) types.CredentialVerifier {
+	maxAge := extraDuration(cfg, "MaxAge")
+	if maxAge <= 0 {
+		maxAge = defaultTelegramMaxAge
+	}
+
+	return &TelegramProvider{
+		Name:     types.TELEGRAM,
+		botToken: cfg.ClientSecret,
+		maxAge:   maxAge,
+	}
+}
+
+// VerifyCredentials verifies the data of the Telegram Login Widget and returns the user,
+// credentials must only hold the fields sent by the widget since all of them are signed
+func (p *TelegramProvider) VerifyCredentials(ctx context.Context, credentials url.Values) (*types.UserInfo, error) {
+	hash := credentials.Get("hash")
+	if hash == "" {
+		return nil, fmt.Errorf("telegram error: hash is missing")
+	}
+
+	// The data-check-string is every received field but hash, sorted by key, as key=value lines
+	keys := make([]string, 0, len(credentials))
+	for key := range credentials {
+		if key != "hash" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, key+"="+credentials.Get(key))
+	}
+
+	secretKey := sha256.Sum256([]byte(p.botToken))
+	mac := hmac.New(sha256.New, secretKey[:])
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(hash))) {
+		return nil, fmt.Errorf("telegram error: hash mismatch")
+	}
+
+	authDate, err := strconv.ParseInt(credentials.Get("auth_date"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("telegram error: invalid auth_date %q", credentials.Get("auth_date"))
+	}
+	issuedAt := time.Unix(authDate, 0)
+	if age := time.Since(issuedAt); age > p.maxAge || age < -time.Minute {
+		return nil, fmt.Errorf("telegram error: auth_date is outdated: issued at %s", issuedAt)
+	}
+
+	telegramUser := TelegramUser{
+		ID:        credentials.Get("id"),
+		FirstName: credentials.Get("first_name"),
+		LastName:  credentials.Get("last_name"),
+		Username:  credentials.Get("username"),
+		PhotoURL:  credentials.Get("photo_url"),
+		AuthDate:  authDate,
+	}
+	if telegramUser.ID == "" {
+		return nil, fmt.Errorf("telegram error: id is missing")
+	}
+
+	name := strings.TrimSpace(telegramUser.FirstName + " " + telegramUser.LastName)
+	if name == "" {
+		name = telegramUser.Username
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: telegramUser.ID,
+		Name:           name,
+		AvatarURL:      telegramUser.PhotoURL,
+		Email:          "", // Telegram does not provide email
+		RawData:        telegramUser,
+	}, nil
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// TikTok Login Kit v2 follows OAuth 2.0 with its own naming.
+//
+// **Key points**:
+// * TikTok expects `client_key` instead of `client_id`, and comma separated scopes.
+// * PKCE is supported: pass oauth2.S256ChallengeOption to GetAuthURL and oauth2.VerifierOption to ExchangeCodeForToken.
+//   Login Kit for web/desktop expects the SHA-256 `code_challenge` hex encoded, the base64url one of S256ChallengeOption
+//   is re-encoded by GetAuthURL.
+// * The `open_id` is returned with the token, the user info fields must be listed explicitly
+//   and the response is wrapped in `{data: {user}, error: {code, message}}`.
+
+type TiktokProvider struct {
+	Name        string
+	config      *oauth2.Config
+	subjectKind string
+}
+
+// NewTiktokProvider creates a new TikTok Provider instance
+//
+// Extra fields: `SubjectID` (`openid` or `unionid`).
+func NewTiktokProvider(cfg *types.OauthConfig) types.Provider {
+	return &TiktokProvider{
+		Name:        types.TIKTOK,
+		subjectKind: extraString(cfg, "SubjectID"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{"user.info.basic"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://www.tiktok.com/v2/auth/authorize/",
+				TokenURL: "https://open.tiktokapis.com/v2/oauth/token/",
+			},
+		},
+	}
+}
+
+func (p *TiktokProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	// TikTok expects client_key instead of client_id
+	authURL := clientKeyAuthURL(p.config, state, opts...)
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return ""
+	}
+	params := u.Query()
+	if challenge := params.Get("code_challenge"); challenge != "" && params.Get("code_challenge_method") == "S256" {
+		digest, err := base64.RawURLEncoding.DecodeString(challenge)
+		if err != nil || len(digest) != sha256.Size {
+			return ""
+		}
+		params.Set("code_challenge", hex.EncodeToString(digest))
+		u.RawQuery = params.Encode()
+	}
+	return u.String()
+}
+
+func (p *TiktokProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	values := url.Values{
+		"client_key":    {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {p.config.RedirectURL},
+	}
+	if verifier := authCodeOptionValues(opts...).Get("code_verifier"); verifier != "" {
+		values.Set("code_verifier", verifier)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.config.Endpoint.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenData struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		RefreshExpiresIn int64  `json:"refresh_expires_in"`
+		OpenID           string `json:"open_id"`
+		Scope            string `json:"scope"`
+		TokenType        string `json:"token_type"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokenData); err != nil {
+		return nil, err
+	}
+	if tokenData.Error != "" || tokenData.AccessToken == "" {
+		return nil, fmt.Errorf("tiktok token error: %s %s", tokenData.Error, tokenData.ErrorDescription)
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+		TokenType:    tokenData.TokenType,
+		Expiry:       time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}
+	// Store open_id/scope in Extra
+	return token.WithExtra(map[string]interface{}{
+		"open_id": tokenData.OpenID,
+		"scope":   tokenData.Scope,
+	}), nil
+}
+
+func (p *TiktokProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	userInfoURL := "https://open.tiktokapis.com/v2/user/info/?fields=" + url.QueryEscape("open_id,union_id,avatar_url,display_name")
+	req, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var userResp struct {
+		Data struct {
+			User struct {
+				OpenID      string `json:"open_id"`
+				UnionID     string `json:"union_id"`
+				AvatarURL   string `json:"avatar_url"`
+				DisplayName string `json:"display_name"`
+			} `json:"user"`
+		} `json:"data"`
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			LogID   string `json:"log_id"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &userResp); err != nil {
+		return nil, err
+	}
+	if userResp.Error.Code != "" && userResp.Error.Code != "ok" {
+		return nil, fmt.Errorf("tiktok error: %s %s (log_id %s)", userResp.Error.Code, userResp.Error.Message, userResp.Error.LogID)
+	}
+
+	tiktokUser := userResp.Data.User
+	openID := tiktokUser.OpenID
+	if openID == "" {
+		openID, _ = token.Extra("open_id").(string)
+	}
+
+	// Prioritize using union_id, unless the subject is configured
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  openID,
+		types.SubjectUnionID: tiktokUser.UnionID,
+	})
+	providerUserID, err := selectSubject("tiktok", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		Name:           tiktokUser.DisplayName,
+		AvatarURL:      tiktokUser.AvatarURL,
+		Email:          "", // TikTok does not provide email
+		RawData:        tiktokUser,
+	}, nil
+}
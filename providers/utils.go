@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/credential"
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// credentialManager returns the `Extra["CredentialManager"]` used to cache app-level credentials,
+// or credential.Default if none is configured
+func credentialManager(cfg *types.OauthConfig) *credential.Manager {
+	if cfg != nil && cfg.Extra != nil {
+		if m, ok := cfg.Extra["CredentialManager"].(*credential.Manager); ok && m != nil {
+			return m
+		}
+	}
+	return credential.Default
+}
+
+// authCodeOptionValues returns the parameters carried by opts, e.g. the `code_verifier` set by oauth2.VerifierOption.
+// It is used by providers that build their token requests manually.
+func authCodeOptionValues(opts ...oauth2.AuthCodeOption) url.Values {
+	c := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "http://localhost"}}
+	u, err := url.Parse(c.AuthCodeURL("", opts...))
+	if err != nil {
+		return url.Values{}
+	}
+	return u.Query()
+}
+
+// extraString returns the string value of an `OauthConfig.Extra` field, or "" if absent
+func extraString(cfg *types.OauthConfig, key string) string {
+	if cfg == nil || cfg.Extra == nil {
+		return ""
+	}
+	s, _ := cfg.Extra[key].(string)
+	return s
+}
+
+// extraBool returns the boolean value of an `OauthConfig.Extra` field,
+// accepting both bool and string ("true", "1") values
+func extraBool(cfg *types.OauthConfig, key string) bool {
+	if cfg == nil || cfg.Extra == nil {
+		return false
+	}
+	switch v := cfg.Extra[key].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true" || v == "1"
+	}
+	return false
+}
+
+// extraDuration returns the duration value of an `OauthConfig.Extra` field,
+// accepting both time.Duration and string ("10m") values
+func extraDuration(cfg *types.OauthConfig, key string) time.Duration {
+	if cfg == nil || cfg.Extra == nil {
+		return 0
+	}
+	switch v := cfg.Extra[key].(type) {
+	case time.Duration:
+		return v
+	case string:
+		d, _ := time.ParseDuration(v)
+		return d
+	}
+	return 0
+}
+
+// extraStrings returns the list value of an `OauthConfig.Extra` field,
+// accepting both []string and comma separated string values
+func extraStrings(cfg *types.OauthConfig, key string) []string {
+	if cfg == nil || cfg.Extra == nil {
+		return nil
+	}
+	switch v := cfg.Extra[key].(type) {
+	case []string:
+		return v
+	case string:
+		var values []string
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// selectSubject returns the primary subject among the identifiers returned by a provider.
+// If kind is configured (`Extra["SubjectID"]`) that identifier is required, so the subject never silently changes;
+// otherwise the first available identifier of fallback is used.
+func selectSubject(provider, kind string, ids map[string]string, fallback ...string) (string, error) {
+	if kind != "" {
+		if id := ids[kind]; id != "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("%s %s is not available for this user", provider, kind)
+	}
+	for _, k := range fallback {
+		if id := ids[k]; id != "" {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("%s user identifier not found", provider)
+}
+
+// tenantScopedID qualifies an identifier only unique within a tenant (e.g. Feishu user_id) as `<tenant>:<id>`,
+// so that the users of two tenants never share a subject; it is dropped when the tenant is unknown
+func tenantScopedID(tenant, id string) string {
+	if tenant == "" || id == "" {
+		return ""
+	}
+	return tenant + ":" + id
+}
+
+// compactIDs drops the empty identifiers, the result is used as UserInfo.AlternateIDs
+func compactIDs(ids map[string]string) map[string]string {
+	compacted := make(map[string]string, len(ids))
+	for k, v := range ids {
+		if v != "" {
+			compacted[k] = v
+		}
+	}
+	return compacted
+}
+
+// clientKeyAuthURL builds the auth URL of providers naming the client ID `client_key`
+// and separating the scopes with commas (Douyin, TikTok), keeping the other params of opts (e.g. PKCE)
+func clientKeyAuthURL(config *oauth2.Config, state string, opts ...oauth2.AuthCodeOption) string {
+	u, err := url.Parse(config.AuthCodeURL(state, opts...))
+	if err != nil {
+		return ""
+	}
+	params := u.Query()
+	params.Del("client_id")
+	params.Set("client_key", config.ClientID)
+	params.Set("scope", strings.Join(config.Scopes, ","))
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// deviceAccessToken polls the token endpoint of the device flow, the terminal errors are wrapped
+// in types.ErrDeviceCodeExpired and types.ErrDeviceAccessDenied
+func deviceAccessToken(ctx context.Context, config *oauth2.Config, da *oauth2.DeviceAuthResponse, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	token, err := config.DeviceAccessToken(ctx, da, opts...)
+	if err == nil {
+		return token, nil
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		switch retrieveErr.ErrorCode {
+		case "expired_token":
+			return nil, fmt.Errorf("%w: %w", types.ErrDeviceCodeExpired, err)
+		// Microsoft Entra ID answers authorization_declined instead of access_denied
+		case "access_denied", "authorization_declined":
+			return nil, fmt.Errorf("%w: %w", types.ErrDeviceAccessDenied, err)
+		}
+	}
+	// The polling stops at the expiry of the device code
+	if errors.Is(err, context.DeadlineExceeded) && !da.Expiry.IsZero() && !time.Now().Before(da.Expiry) {
+		return nil, fmt.Errorf("%w: %w", types.ErrDeviceCodeExpired, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// deviceTokenServer is a token endpoint answering the device code polls with errors, in order, then with a token
+type deviceTokenServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	errors []string
+	polls  []time.Time
+}
+
+func newDeviceTokenServer(t *testing.T, errors ...string) *deviceTokenServer {
+	s := &deviceTokenServer{errors: errors}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" || r.FormValue("device_code") != "device-code" {
+			t.Errorf("unexpected token request %v", r.Form)
+		}
+
+		s.mu.Lock()
+		s.polls = append(s.polls, time.Now())
+		code := ""
+		if len(s.errors) > 0 {
+			code, s.errors = s.errors[0], s.errors[1:]
+		}
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if code != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": code})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// pollTimes returns the time of each poll
+func (s *deviceTokenServer) pollTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.polls...)
+}
+
+func (s *deviceTokenServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID: "client-id",
+		Endpoint: oauth2.Endpoint{TokenURL: s.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+	}
+}
+
+func TestDeviceAccessToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		errors  []string
+		wantErr error
+	}{
+		{name: "authorized", errors: []string{"authorization_pending"}},
+		{name: "expired_token", errors: []string{"authorization_pending", "expired_token"}, wantErr: types.ErrDeviceCodeExpired},
+		{name: "access_denied", errors: []string{"authorization_pending", "access_denied"}, wantErr: types.ErrDeviceAccessDenied},
+		{name: "authorization_declined", errors: []string{"authorization_pending", "authorization_declined"}, wantErr: types.ErrDeviceAccessDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			server := newDeviceTokenServer(t, tt.errors...)
+			da := &oauth2.DeviceAuthResponse{DeviceCode: "device-code", Interval: 1, Expiry: time.Now().Add(time.Minute)}
+
+			token, err := deviceAccessToken(context.Background(), server.config(), da)
+			if tt.wantErr == nil {
+				if err != nil || token.AccessToken != "access-token" {
+					t.Fatalf("got %v, %v, want the access token", token, err)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if polls := server.pollTimes(); len(polls) != 2 {
+				t.Fatalf("%d polls, want 2", len(polls))
+			}
+		})
+	}
+}
+
+func TestDeviceAccessTokenSlowDown(t *testing.T) {
+	t.Parallel()
+	server := newDeviceTokenServer(t, "slow_down", "access_denied")
+	da := &oauth2.DeviceAuthResponse{DeviceCode: "device-code", Interval: 1, Expiry: time.Now().Add(time.Minute)}
+
+	if _, err := deviceAccessToken(context.Background(), server.config(), da); !errors.Is(err, types.ErrDeviceAccessDenied) {
+		t.Fatalf("err = %v, want %v", err, types.ErrDeviceAccessDenied)
+	}
+	// slow_down adds 5 seconds to the polling interval
+	polls := server.pollTimes()
+	if len(polls) != 2 {
+		t.Fatalf("%d polls, want 2", len(polls))
+	}
+	if interval := polls[1].Sub(polls[0]); interval < 6*time.Second {
+		t.Fatalf("polled %s after slow_down, want the interval increased by 5s", interval)
+	}
+}
+
+func TestDeviceAccessTokenExpiry(t *testing.T) {
+	t.Parallel()
+	pending := make([]string, 10)
+	for i := range pending {
+		pending[i] = "authorization_pending"
+	}
+
+	// The polling stops at the expiry of the device code
+	server := newDeviceTokenServer(t, pending...)
+	da := &oauth2.DeviceAuthResponse{DeviceCode: "device-code", Interval: 1, Expiry: time.Now().Add(1500 * time.Millisecond)}
+	if _, err := deviceAccessToken(context.Background(), server.config(), da); !errors.Is(err, types.ErrDeviceCodeExpired) {
+		t.Fatalf("err = %v, want %v", err, types.ErrDeviceCodeExpired)
+	}
+
+	// A deadline of the caller before the expiry is not the expiry of the device code
+	server = newDeviceTokenServer(t, pending...)
+	da = &oauth2.DeviceAuthResponse{DeviceCode: "device-code", Interval: 1, Expiry: time.Now().Add(time.Minute)}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	_, err := deviceAccessToken(ctx, server.config(), da)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, types.ErrDeviceCodeExpired) {
+		t.Fatalf("err = %v, want the deadline of the caller", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -16,21 +18,51 @@ import (
 	"go.xiexianbin.cn/authkit/types"
 )
 
+// WeChat supports two browser based logins with the same token and userinfo APIs.
+//
+// **Key points**:
+// * `Extra["Mode"]` selects the website QR-code login (`website`, default, `snsapi_login` scope)
+//   or the Official Account H5 login inside the WeChat app browser (`official_account`).
+// * In `official_account` mode `Extra["Scope"]` is `snsapi_userinfo` (default, asks for consent)
+//   or `snsapi_base` (silent, only the openid is available, `sns/userinfo` is not called).
+// * WeChat uses appid/secret instead of client_id/client_secret and requires #wechat_redirect at the end of the auth URL.
+
+const (
+	// WechatModeWebsite is the website QR-code login of a WeChat Open Platform website app
+	WechatModeWebsite = "website"
+	// WechatModeOfficialAccount is the H5 login of an Official Account, used inside the WeChat app browser
+	WechatModeOfficialAccount = "official_account"
+)
+
 type WechatProvider struct {
-	Name   string
-	config *oauth2.Config
+	Name        string
+	config      *oauth2.Config
+	subjectKind string
 }
 
+// NewWechatProvider creates a new WeChat Provider instance
+//
+// Extra fields: `Mode` (`website` or `official_account`), `Scope` (`snsapi_userinfo` or `snsapi_base`, official_account mode only)
+// and `SubjectID` (`openid` or `unionid`).
 func NewWechatProvider(cfg *types.OauthConfig) types.Provider {
+	authURL, scope := "https://open.weixin.qq.com/connect/qrconnect", "snsapi_login"
+	if extraString(cfg, "Mode") == WechatModeOfficialAccount {
+		authURL, scope = "https://open.weixin.qq.com/connect/oauth2/authorize", extraString(cfg, "Scope")
+		if scope == "" {
+			scope = "snsapi_userinfo"
+		}
+	}
+
 	return &WechatProvider{
-		Name: types.WECHAT,
+		Name:        types.WECHAT,
+		subjectKind: extraString(cfg, "SubjectID"),
 		config: &oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
 			RedirectURL:  cfg.RedirectURL,
-			Scopes:       []string{"snsapi_login"},
+			Scopes:       []string{scope},
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://open.weixin.qq.com/connect/qrconnect",
+				AuthURL:  authURL,
 				TokenURL: "https://api.weixin.qq.com/sns/oauth2/access_token",
 			},
 		},
@@ -38,18 +70,26 @@ func NewWechatProvider(cfg *types.OauthConfig) types.Provider {
 }
 
 func (p *WechatProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	// Wechat expects appid instead of client_id and does not support PKCE
+	params := url.Values{
+		"appid":         {p.config.ClientID},
+		"redirect_uri":  {p.config.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {strings.Join(p.config.Scopes, ",")},
+		"state":         {state},
+	}
 	// Wechat requires #wechat_redirect at the end
-	url := p.config.AuthCodeURL(state, opts...)
-	return url + "#wechat_redirect"
+	return p.config.Endpoint.AuthURL + "?" + params.Encode() + "#wechat_redirect"
 }
 
 func (p *WechatProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	// Wechat uses appid/secret instead of client_id/client_secret
 	tokenURL := fmt.Sprintf(
-		"https://api.weixin.qq.com/sns/oauth2/access_token?appid=%s&secret=%s&code=%s&grant_type=authorization_code",
-		p.config.ClientID,
-		p.config.ClientSecret,
-		code,
+		"%s?appid=%s&secret=%s&code=%s&grant_type=authorization_code",
+		p.config.Endpoint.TokenURL,
+		url.QueryEscape(p.config.ClientID),
+		url.QueryEscape(p.config.ClientSecret),
+		url.QueryEscape(code),
 	)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL, nil)
@@ -93,10 +133,11 @@ func (p *WechatProvider) ExchangeCodeForToken(ctx context.Context, code string,
 		// ExpiresIn is int seconds
 		Expiry: time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
 	}
-	// Store openid/unionid in Extra
+	// Store openid/unionid/scope in Extra
 	return token.WithExtra(map[string]interface{}{
 		"openid":  tokenData.OpenID,
 		"unionid": tokenData.UnionID,
+		"scope":   tokenData.Scope,
 	}), nil
 }
 
@@ -106,7 +147,33 @@ func (p *WechatProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (
 		return nil, fmt.Errorf("openid not found in token")
 	}
 
-	userInfoURL := fmt.Sprintf("https://api.weixin.qq.com/sns/userinfo?access_token=%s&openid=%s", token.AccessToken, openid)
+	// snsapi_base is a silent authorization, the profile can not be read with its access token
+	if scope, _ := token.Extra("scope").(string); isWechatBaseScope(scope) {
+		unionid, _ := token.Extra("unionid").(string)
+		wechatUser := struct {
+			OpenID  string `json:"openid"`
+			UnionID string `json:"unionid"`
+		}{
+			OpenID:  openid,
+			UnionID: unionid,
+		}
+		subject, ids, err := wechatSubject(p.subjectKind, openid, unionid)
+		if err != nil {
+			return nil, err
+		}
+		return &types.UserInfo{
+			Provider:       types.WECHAT,
+			ProviderUserID: subject,
+			AlternateIDs:   ids,
+			RawData:        wechatUser,
+		}, nil
+	}
+
+	userInfoURL := fmt.Sprintf(
+		"https://api.weixin.qq.com/sns/userinfo?access_token=%s&openid=%s",
+		url.QueryEscape(token.AccessToken),
+		url.QueryEscape(openid),
+	)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
 	if err != nil {
@@ -141,16 +208,81 @@ func (p *WechatProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (
 		return nil, fmt.Errorf("wechat error: %s", wechatUser.ErrMsg)
 	}
 
-	providerUserID := wechatUser.UnionID
-	if providerUserID == "" {
-		providerUserID = wechatUser.OpenID
+	subject, ids, err := wechatSubject(p.subjectKind, wechatUser.OpenID, wechatUser.UnionID)
+	if err != nil {
+		return nil, err
 	}
 
 	return &types.UserInfo{
 		Provider:       types.WECHAT,
-		ProviderUserID: providerUserID,
+		ProviderUserID: subject,
+		AlternateIDs:   ids,
 		Name:           wechatUser.Nickname,
 		AvatarURL:      wechatUser.HeadImgURL,
 		RawData:        wechatUser,
 	}, nil
 }
+
+// ValidateToken checks with `sns/auth` that the access token is still valid for the openid stored in the token
+func (p *WechatProvider) ValidateToken(ctx context.Context, token *oauth2.Token) error {
+	openid, ok := token.Extra("openid").(string)
+	if !ok {
+		return fmt.Errorf("openid not found in token")
+	}
+
+	authURL := fmt.Sprintf(
+		"https://api.weixin.qq.com/sns/auth?access_token=%s&openid=%s",
+		url.QueryEscape(token.AccessToken),
+		url.QueryEscape(openid),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", authURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	if result.ErrCode != 0 {
+		return fmt.Errorf("wechat error: %d %s", result.ErrCode, result.ErrMsg)
+	}
+	return nil
+}
+
+// isWechatBaseScope reports whether only the silent snsapi_base scope was granted
+func isWechatBaseScope(scope string) bool {
+	for _, s := range strings.Split(scope, ",") {
+		if s != "snsapi_base" {
+			return false
+		}
+	}
+	return scope != ""
+}
+
+// wechatSubject returns the primary subject and the alternate IDs of a WeChat user.
+// Unless `Extra["SubjectID"]` is configured, it prioritizes the unionid, which is shared by all apps
+// bound to the same WeChat Open Platform account, and falls back to the app specific openid.
+func wechatSubject(kind, openid, unionid string) (string, map[string]string, error) {
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  openid,
+		types.SubjectUnionID: unionid,
+	})
+	subject, err := selectSubject("wechat", kind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	return subject, ids, err
+}
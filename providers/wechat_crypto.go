@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Mini programs submit user data encrypted (`encryptedData` + `iv`) or signed (`rawData` + `signature`)
+// with the `session_key` returned by code2Session.
+//
+// **Key points**:
+// * Encrypted data is AES-128-CBC with PKCS#7 padding, the key is the base64 decoded `session_key`.
+// * The decrypted JSON carries a `watermark` with the appid and timestamp, which must be checked
+//   (not older than the max age, nor ahead of now by more than a small clock skew).
+// * The signature is `sha1(rawData + session_key)` in hex.
+// ref: https://developers.weixin.qq.com/miniprogram/dev/framework/open-ability/signature.html
+
+const (
+	// defaultWatermarkMaxAge is how old the watermark of decrypted data may be, unless `Extra["WatermarkMaxAge"]` is set
+	defaultWatermarkMaxAge = 10 * time.Minute
+	// maxWatermarkClockSkew is how far in the future the watermark of decrypted data may be
+	maxWatermarkClockSkew = time.Minute
+)
+
+// WechatWatermark is embedded by WeChat in decrypted data
+type WechatWatermark struct {
+	AppID     string `json:"appid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// WechatPhoneNumber is the decrypted payload of `getPhoneNumber`
+type WechatPhoneNumber struct {
+	PhoneNumber     string          `json:"phoneNumber"`     // with the country code for non-Chinese numbers
+	PurePhoneNumber string          `json:"purePhoneNumber"` // without the country code
+	CountryCode     string          `json:"countryCode"`
+	Watermark       WechatWatermark `json:"watermark"`
+}
+
+// MergeInto sets the phone number of userInfo
+func (n *WechatPhoneNumber) MergeInto(userInfo *types.UserInfo) {
+	userInfo.Phone = n.PhoneNumber
+}
+
+// WechatUserProfile is the decrypted payload of `getUserProfile` / `getUserInfo`, or the verified `rawData`
+type WechatUserProfile struct {
+	OpenID    string          `json:"openId"`
+	UnionID   string          `json:"unionId"`
+	NickName  string          `json:"nickName"`
+	Gender    int             `json:"gender"`
+	City      string          `json:"city"`
+	Province  string          `json:"province"`
+	Country   string          `json:"country"`
+	AvatarURL string          `json:"avatarUrl"`
+	Language  string          `json:"language"`
+	Watermark WechatWatermark `json:"watermark"`
+}
+
+// MergeInto sets the name and avatar of userInfo from the profile
+func (u *WechatUserProfile) MergeInto(userInfo *types.UserInfo) {
+	if u.NickName != "" {
+		userInfo.Name = u.NickName
+	}
+	if u.AvatarURL != "" {
+		userInfo.AvatarURL = u.AvatarURL
+	}
+}
+
+// DecryptPhoneNumber decrypts the `getPhoneNumber` data and checks its watermark
+func (p *WechatMiniProgramProvider) DecryptPhoneNumber(sessionKey, encryptedData, iv string) (*WechatPhoneNumber, error) {
+	var phone WechatPhoneNumber
+	if err := p.decrypt(sessionKey, encryptedData, iv, &phone, &phone.Watermark); err != nil {
+		return nil, err
+	}
+	return &phone, nil
+}
+
+// DecryptUserProfile decrypts the `getUserProfile` data and checks its watermark
+func (p *WechatMiniProgramProvider) DecryptUserProfile(sessionKey, encryptedData, iv string) (*WechatUserProfile, error) {
+	var profile WechatUserProfile
+	if err := p.decrypt(sessionKey, encryptedData, iv, &profile, &profile.Watermark); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// VerifyUserProfile checks the signature of the `rawData` profile and returns it
+func (p *WechatMiniProgramProvider) VerifyUserProfile(sessionKey, rawData, signature string) (*WechatUserProfile, error) {
+	if err := VerifyWechatSignature(sessionKey, rawData, signature); err != nil {
+		return nil, err
+	}
+	var profile WechatUserProfile
+	if err := json.Unmarshal([]byte(rawData), &profile); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal wechat raw data: %w", err)
+	}
+	return &profile, nil
+}
+
+// decrypt decrypts data into out and checks the watermark against the app ID and the max age
+func (p *WechatMiniProgramProvider) decrypt(sessionKey, encryptedData, iv string, out any, watermark *WechatWatermark) error {
+	plaintext, err := DecryptWechatData(sessionKey, encryptedData, iv)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(plaintext, out); err != nil {
+		return fmt.Errorf("failed to unmarshal wechat decrypted data: %w", err)
+	}
+
+	if watermark.AppID != p.config.ClientID {
+		return fmt.Errorf("wechat watermark appid %q does not match %q", watermark.AppID, p.config.ClientID)
+	}
+	issuedAt := time.Unix(watermark.Timestamp, 0)
+	if time.Since(issuedAt) > p.watermarkMaxAge {
+		return fmt.Errorf("wechat watermark is too old: issued at %s", issuedAt)
+	}
+	if time.Until(issuedAt) > maxWatermarkClockSkew {
+		return fmt.Errorf("wechat watermark is in the future: issued at %s", issuedAt)
+	}
+	return nil
+}
+
+// DecryptWechatData decrypts mini program `encryptedData` with the `session_key` and `iv` (all base64 encoded)
+func DecryptWechatData(sessionKey, encryptedData, iv string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wechat session_key: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wechat encrypted data: %w", err)
+	}
+	ivBytes, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wechat iv: %w", err)
+	}
+
+	// AES-128: aes.NewCipher would also accept the 24 and 32 bytes keys of AES-192 and AES-256
+	if len(key) != 16 {
+		return nil, fmt.Errorf("invalid wechat session_key length %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wechat session_key: %w", err)
+	}
+	if len(ivBytes) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid wechat iv length %d", len(ivBytes))
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid wechat encrypted data length %d", len(ciphertext))
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, ivBytes).CryptBlocks(plaintext, ciphertext)
+
+	// Remove the PKCS#7 padding
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, fmt.Errorf("invalid wechat decrypted data padding")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("invalid wechat decrypted data padding")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// VerifyWechatSignature checks that signature is `sha1(rawData + session_key)`
+func VerifyWechatSignature(sessionKey, rawData, signature string) error {
+	sum := sha1.Sum([]byte(rawData + sessionKey))
+	expected := hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return fmt.Errorf("wechat signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// The sample of the WeChat documentation, decrypted with its session_key and iv
+// ref: https://developers.weixin.qq.com/miniprogram/dev/framework/open-ability/signature.html
+const (
+	wechatSampleAppID      = "wx4f4bc4dec97d474b"
+	wechatSampleSessionKey = "tiihtNczf5v6AKRyjwEUhQ=="
+	wechatSampleIV         = "r7BXXKkLb8qrSNn05n0qiA=="
+	wechatSampleData       = "CiyLU1Aw2KjvrjMdj8YKliAjtP4gsMZMQmRzooG2xrDcvSnxIMXFufNstNGTyaGS9uT5geRa0W4oTOb1WT7fJlAC+oNPdbB+" +
+		"3hVbJSRgv+4lGOETKUQz6OYStslQ142dNCuabNPGBzlooOmB231qMM85d2/fV6ChevvXvQP8Hkue1poOFtnEtpyxVLW1zAo6" +
+		"/1Xx1COxFvrc2d7UL/lmHInNlxuacJXwu0fjpXfz/YqYzBIBzD6WUfTIF9GRHpOn/Hz7saL8xz+W//FRAUid1OksQaQx4CMs" +
+		"8LOddcQhULW4ucetDf96JcR3g0gfRK4PC7E/r7Z6xNrXd2UIeorGj5Ef7b1pJAYB6Y5anaHqZ9J6nKEBvB4DnNLIVWSgARns" +
+		"/8wR2SiRS7MNACwTyrGvt9ts8p12PKFdlqYTopNHR1Vf7XjfhQlVsAJdNiKdYmYVoKlaRv85IfVunYzO0IKXsyl7JCUjCpoG" +
+		"20f0a04COwfneQAGGwd5oa+T8yO5hzuyDb/XcxxmK01EpqOyuxINew=="
+)
+
+// encryptWechatData encrypts plaintext as WeChat does, padded with padding (PKCS#7 when nil)
+func encryptWechatData(t *testing.T, plaintext []byte, padding []byte) string {
+	t.Helper()
+	key, _ := base64.StdEncoding.DecodeString(wechatSampleSessionKey)
+	iv, _ := base64.StdEncoding.DecodeString(wechatSampleIV)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if padding == nil {
+		n := aes.BlockSize - len(plaintext)%aes.BlockSize
+		padding = bytes.Repeat([]byte{byte(n)}, n)
+	}
+	padded := append(append([]byte{}, plaintext...), padding...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	return base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+func newTestWechatMiniProgramProvider(extra map[string]any) *WechatMiniProgramProvider {
+	return NewWechatMiniProgramProvider(&types.OauthConfig{ClientID: wechatSampleAppID, Extra: extra}).(*WechatMiniProgramProvider)
+}
+
+func TestDecryptWechatDataSample(t *testing.T) {
+	plaintext, err := DecryptWechatData(wechatSampleSessionKey, wechatSampleData, wechatSampleIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(plaintext, []byte(`{"openId":"oGZUI0egBJY1zhBYw2KhdUfwVJJE","nickName":"Band"`)) {
+		t.Fatalf("unexpected plaintext %s", plaintext)
+	}
+
+	// The watermark of the sample is from 2016, it is only accepted with a large max age
+	if _, err := newTestWechatMiniProgramProvider(nil).DecryptUserProfile(wechatSampleSessionKey, wechatSampleData, wechatSampleIV); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Fatalf("stale watermark: err = %v", err)
+	}
+	p := newTestWechatMiniProgramProvider(map[string]any{"WatermarkMaxAge": 100 * 365 * 24 * time.Hour})
+	profile, err := p.DecryptUserProfile(wechatSampleSessionKey, wechatSampleData, wechatSampleIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.OpenID != "oGZUI0egBJY1zhBYw2KhdUfwVJJE" || profile.UnionID != "ocMvos6NjeKLIBqg5Mr9QjxrP1FA" || profile.NickName != "Band" {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+}
+
+func TestDecryptWechatDataInvalid(t *testing.T) {
+	tests := []struct {
+		name          string
+		sessionKey    string
+		encryptedData string
+		iv            string
+	}{
+		{name: "AES-256 session_key", sessionKey: base64.StdEncoding.EncodeToString(make([]byte, 32)), encryptedData: wechatSampleData, iv: wechatSampleIV},
+		{name: "short iv", sessionKey: wechatSampleSessionKey, encryptedData: wechatSampleData, iv: base64.StdEncoding.EncodeToString(make([]byte, 8))},
+		{name: "truncated data", sessionKey: wechatSampleSessionKey, encryptedData: base64.StdEncoding.EncodeToString(make([]byte, 20)), iv: wechatSampleIV},
+		{name: "zero padding", sessionKey: wechatSampleSessionKey, encryptedData: encryptWechatData(t, []byte("{}"), bytes.Repeat([]byte{0}, 14)), iv: wechatSampleIV},
+		{name: "inconsistent padding", sessionKey: wechatSampleSessionKey, encryptedData: encryptWechatData(t, []byte("{}"), append(bytes.Repeat([]byte{1}, 13), 14)), iv: wechatSampleIV},
+		{name: "padding over the block", sessionKey: wechatSampleSessionKey, encryptedData: encryptWechatData(t, []byte("{}"), bytes.Repeat([]byte{17}, 14)), iv: wechatSampleIV},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if plaintext, err := DecryptWechatData(tt.sessionKey, tt.encryptedData, tt.iv); err == nil {
+				t.Fatalf("decrypted %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestWechatWatermark(t *testing.T) {
+	p := newTestWechatMiniProgramProvider(nil)
+	phone := func(appID string, issuedAt time.Time) string {
+		return encryptWechatData(t, []byte(fmt.Sprintf(
+			`{"phoneNumber":"+8613800000000","purePhoneNumber":"13800000000","countryCode":"86","watermark":{"appid":%q,"timestamp":%d}}`,
+			appID, issuedAt.Unix(),
+		)), nil)
+	}
+
+	number, err := p.DecryptPhoneNumber(wechatSampleSessionKey, phone(wechatSampleAppID, time.Now()), wechatSampleIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number.PurePhoneNumber != "13800000000" {
+		t.Fatalf("unexpected phone number %+v", number)
+	}
+
+	tests := []struct {
+		name          string
+		encryptedData string
+		wantErr       string
+	}{
+		{name: "wrong appid", encryptedData: phone("wx0000000000000000", time.Now()), wantErr: "does not match"},
+		{name: "stale", encryptedData: phone(wechatSampleAppID, time.Now().Add(-time.Hour)), wantErr: "too old"},
+		{name: "future", encryptedData: phone(wechatSampleAppID, time.Now().Add(time.Hour)), wantErr: "in the future"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.DecryptPhoneNumber(wechatSampleSessionKey, tt.encryptedData, wechatSampleIV)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWechatSignature(t *testing.T) {
+	rawData := `{"nickName":"Band","gender":1,"language":"zh_CN","city":"Guangzhou","province":"Guangdong","country":"CN","avatarUrl":"http://wx.qlogo.cn/avatar"}`
+	sum := sha1.Sum([]byte(rawData + wechatSampleSessionKey))
+	signature := hex.EncodeToString(sum[:])
+
+	profile, err := newTestWechatMiniProgramProvider(nil).VerifyUserProfile(wechatSampleSessionKey, rawData, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.NickName != "Band" {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+
+	if err := VerifyWechatSignature(wechatSampleSessionKey, strings.Replace(rawData, "Band", "Eve", 1), signature); err == nil {
+		t.Fatal("tampered rawData accepted")
+	}
+	if err := VerifyWechatSignature("another-session-key", rawData, signature); err == nil {
+		t.Fatal("signature of another session_key accepted")
+	}
+}
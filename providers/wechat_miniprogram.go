@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// WeChat Mini Program login has no browser redirect at all.
+//
+// **Key points**:
+// * The mini program calls `wx.login()` and sends the code to the server, `GetAuthURL` is not used.
+// * The code is exchanged by `sns/jscode2session` for the `openid`, `unionid` and `session_key`.
+// * The `session_key` is kept in the token Extra (see WechatSessionKey) and never put in the UserInfo,
+//   it is needed to decrypt and verify the data submitted by the mini program.
+
+type WechatMiniProgramProvider struct {
+	Name            string
+	config          *oauth2.Config
+	watermarkMaxAge time.Duration
+	subjectKind     string
+}
+
+// NewWechatMiniProgramProvider creates a new WeChat Mini Program Provider instance
+//
+// Extra fields: `WatermarkMaxAge` (how old the watermark of decrypted data may be, 10 minutes by default)
+// and `SubjectID` (`openid` or `unionid`).
+func NewWechatMiniProgramProvider(cfg *types.OauthConfig) types.Provider {
+	watermarkMaxAge := extraDuration(cfg, "WatermarkMaxAge")
+	if watermarkMaxAge <= 0 {
+		watermarkMaxAge = defaultWatermarkMaxAge
+	}
+
+	return &WechatMiniProgramProvider{
+		Name:            types.WECHAT_MINIPROGRAM,
+		watermarkMaxAge: watermarkMaxAge,
+		subjectKind:     extraString(cfg, "SubjectID"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				TokenURL: "https://api.weixin.qq.com/sns/jscode2session",
+			},
+		},
+	}
+}
+
+// GetAuthURL returns an empty string, mini programs get the code from `wx.login()` without any redirect
+func (p *WechatMiniProgramProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return ""
+}
+
+func (p *WechatMiniProgramProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	sessionURL := fmt.Sprintf(
+		"%s?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code",
+		p.config.Endpoint.TokenURL,
+		url.QueryEscape(p.config.ClientID),
+		url.QueryEscape(p.config.ClientSecret),
+		url.QueryEscape(code),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", sessionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var session struct {
+		OpenID     string `json:"openid"`
+		SessionKey string `json:"session_key"`
+		UnionID    string `json:"unionid"`
+		ErrCode    int    `json:"errcode"`
+		ErrMsg     string `json:"errmsg"`
+	}
+
+	if err := json.Unmarshal(body, &session); err != nil {
+		return nil, err
+	}
+
+	if session.ErrCode != 0 {
+		return nil, fmt.Errorf("wechat error: %d %s", session.ErrCode, session.ErrMsg)
+	}
+	if session.OpenID == "" || session.SessionKey == "" {
+		return nil, fmt.Errorf("wechat error: openid or session_key not returned")
+	}
+
+	// There is no access token in the mini program login, the session_key is the user scoped credential
+	token := &oauth2.Token{}
+	return token.WithExtra(map[string]interface{}{
+		"openid":      session.OpenID,
+		"unionid":     session.UnionID,
+		"session_key": session.SessionKey,
+	}), nil
+}
+
+func (p *WechatMiniProgramProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	openid, ok := token.Extra("openid").(string)
+	if !ok || openid == "" {
+		return nil, fmt.Errorf("openid not found in token")
+	}
+	unionid, _ := token.Extra("unionid").(string)
+
+	// The profile is not available from code2Session, it comes from the decrypted user data
+	wechatUser := struct {
+		OpenID  string `json:"openid"`
+		UnionID string `json:"unionid"`
+	}{
+		OpenID:  openid,
+		UnionID: unionid,
+	}
+
+	subject, ids, err := wechatSubject(p.subjectKind, openid, unionid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: subject,
+		AlternateIDs:   ids,
+		RawData:        wechatUser,
+	}, nil
+}
+
+// WechatSessionKey returns the mini program `session_key` stored in a token returned by
+// WechatMiniProgramProvider.ExchangeCodeForToken, or "" if there is none
+func WechatSessionKey(token *oauth2.Token) string {
+	if token == nil {
+		return ""
+	}
+	sessionKey, _ := token.Extra("session_key").(string)
+	return sessionKey
+}
@@ -0,0 +1,370 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/credential"
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// WeCom (WeChat Work) uses a two-token model instead of a user access token.
+//
+// **Key points**:
+// * `ClientID` is the corp ID and `ClientSecret` is the secret of the self-built app, `Extra["AgentID"]` is its agent ID.
+// * A corp `access_token` is issued from corpid+secret, it is valid for 2 hours and cached by the credential manager.
+// * The user `code` is resolved with the corp token by `auth/getuserinfo`, which returns the `userid` (members)
+//   or `openid` (non-members) and an optional `user_ticket` for `auth/getuserdetail`.
+// * `Extra["Mode"]` selects the web QR-code login (`web`, default) or the in-WeCom-browser OAuth (`oauth`).
+
+const (
+	// WecomModeWeb is the web QR-code login, used from a normal browser
+	WecomModeWeb = "web"
+	// WecomModeOAuth is the OAuth authorization, used inside the WeCom client browser
+	WecomModeOAuth = "oauth"
+)
+
+const wecomAPIBaseURL = "https://qyapi.weixin.qq.com/cgi-bin"
+
+// wecomError is the `{errcode, errmsg}` error envelope of WeCom APIs
+type wecomError struct {
+	ErrCode int
+	ErrMsg  string
+}
+
+func (e *wecomError) Error() string {
+	return fmt.Sprintf("wecom error: %d %s", e.ErrCode, e.ErrMsg)
+}
+
+// Unwrap reports the invalid (40014) and expired (42001) access_token errors as credential.ErrExpired
+func (e *wecomError) Unwrap() error {
+	if e.ErrCode == 40014 || e.ErrCode == 42001 {
+		return credential.ErrExpired
+	}
+	return nil
+}
+
+type WecomProvider struct {
+	Name        string
+	config      *oauth2.Config
+	agentID     string
+	mode        string
+	membersOnly bool
+	credentials *credential.Manager
+	subjectKind string
+}
+
+// NewWecomProvider creates a new WeCom Provider instance
+//
+// Extra fields: `AgentID`, `Mode` (`web` or `oauth`), `Scope` (`snsapi_base` or `snsapi_privateinfo`, oauth mode only),
+// `MembersOnly` (reject users who are not members of the corp), `CredentialManager` (caches the corp access_token)
+// and `SubjectID` (`user_id` or `openid`).
+func NewWecomProvider(cfg *types.OauthConfig) types.Provider {
+	mode := extraString(cfg, "Mode")
+	if mode == "" {
+		mode = WecomModeWeb
+	}
+	scope := extraString(cfg, "Scope")
+	if scope == "" {
+		scope = "snsapi_base"
+	}
+
+	return &WecomProvider{
+		Name:        types.WECOM,
+		agentID:     extraString(cfg, "AgentID"),
+		mode:        mode,
+		membersOnly: extraBool(cfg, "MembersOnly"),
+		subjectKind: extraString(cfg, "SubjectID"),
+		credentials: credentialManager(cfg),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{scope},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://login.work.weixin.qq.com/wwlogin/sso/login",
+				TokenURL: wecomAPIBaseURL + "/gettoken",
+			},
+		},
+	}
+}
+
+// CorpID returns the corp ID this provider logs users in to
+func (p *WecomProvider) CorpID() string {
+	return p.config.ClientID
+}
+
+func (p *WecomProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	// WeCom uses appid/agentid instead of client_id and does not support PKCE, so opts are ignored
+	if p.mode == WecomModeOAuth {
+		params := url.Values{
+			"appid":         {p.config.ClientID},
+			"redirect_uri":  {p.config.RedirectURL},
+			"response_type": {"code"},
+			"scope":         {p.config.Scopes[0]},
+			"state":         {state},
+		}
+		if p.agentID != "" {
+			params.Set("agentid", p.agentID)
+		}
+		// WeCom requires #wechat_redirect at the end
+		return "https://open.weixin.qq.com/connect/oauth2/authorize?" + params.Encode() + "#wechat_redirect"
+	}
+
+	params := url.Values{
+		"login_type":   {"CorpApp"},
+		"appid":        {p.config.ClientID},
+		"agentid":      {p.agentID},
+		"redirect_uri": {p.config.RedirectURL},
+		"state":        {state},
+	}
+	return p.config.Endpoint.AuthURL + "?" + params.Encode()
+}
+
+// AppAccessToken returns the cached corp access_token, it can be used to call other WeCom APIs
+func (p *WecomProvider) AppAccessToken(ctx context.Context) (string, error) {
+	return p.credentials.Get(ctx, p.credentialKey(), p.fetchCorpAccessToken)
+}
+
+func (p *WecomProvider) credentialKey() string {
+	return "wecom:access_token:" + p.config.ClientID + ":" + p.agentID
+}
+
+// fetchCorpAccessToken issues a new corp access_token from corpid+secret
+func (p *WecomProvider) fetchCorpAccessToken(ctx context.Context) (*credential.Token, error) {
+	tokenURL := fmt.Sprintf(
+		"%s?corpid=%s&corpsecret=%s",
+		p.config.Endpoint.TokenURL,
+		url.QueryEscape(p.config.ClientID),
+		url.QueryEscape(p.config.ClientSecret),
+	)
+
+	var tokenData struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := p.doRequest(ctx, "GET", tokenURL, nil, &tokenData); err != nil {
+		return nil, err
+	}
+
+	return &credential.Token{
+		Value:     tokenData.AccessToken,
+		ExpiresAt: time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// doWithCorpToken calls fn with the corp access_token, retrying once with a new one if it was rejected
+func (p *WecomProvider) doWithCorpToken(ctx context.Context, fn func(corpToken string) error) error {
+	return p.credentials.Do(ctx, p.credentialKey(), p.fetchCorpAccessToken, fn)
+}
+
+func (p *WecomProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	var identity struct {
+		UserID         string `json:"userid"`
+		UserTicket     string `json:"user_ticket"`
+		ExpiresIn      int    `json:"expires_in"`
+		OpenID         string `json:"openid"`
+		ExternalUserID string `json:"external_userid"`
+	}
+	err := p.doWithCorpToken(ctx, func(corpToken string) error {
+		userInfoURL := fmt.Sprintf(
+			"%s/auth/getuserinfo?access_token=%s&code=%s",
+			wecomAPIBaseURL,
+			url.QueryEscape(corpToken),
+			url.QueryEscape(code),
+		)
+		return p.doRequest(ctx, "GET", userInfoURL, nil, &identity)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if identity.UserID == "" && identity.OpenID == "" {
+		return nil, fmt.Errorf("wecom error: neither userid nor openid returned")
+	}
+
+	// There is no user access token in WeCom, the user_ticket (if any) is the user scoped credential
+	token := &oauth2.Token{
+		AccessToken: identity.UserTicket,
+		Expiry:      time.Now().Add(time.Duration(identity.ExpiresIn) * time.Second),
+	}
+	return token.WithExtra(map[string]interface{}{
+		"corpid":          p.config.ClientID,
+		"userid":          identity.UserID,
+		"user_ticket":     identity.UserTicket,
+		"openid":          identity.OpenID,
+		"external_userid": identity.ExternalUserID,
+	}), nil
+}
+
+func (p *WecomProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	userID, _ := token.Extra("userid").(string)
+	openID, _ := token.Extra("openid").(string)
+
+	if userID == "" {
+		if p.membersOnly {
+			return nil, fmt.Errorf("wecom user is not a member of corp %s", p.config.ClientID)
+		}
+		if openID == "" {
+			return nil, fmt.Errorf("userid or openid not found in token")
+		}
+		// Non-members only have an openid, no profile is available
+		ids := map[string]string{types.SubjectOpenID: openID}
+		providerUserID, err := selectSubject("wecom", p.subjectKind, ids, types.SubjectOpenID)
+		if err != nil {
+			return nil, err
+		}
+		return &types.UserInfo{
+			Provider:       p.Name,
+			ProviderUserID: providerUserID,
+			AlternateIDs:   ids,
+			RawData:        ids,
+		}, nil
+	}
+
+	var wecomUser struct {
+		UserID  string `json:"userid"`
+		Name    string `json:"name"`
+		Alias   string `json:"alias"`
+		Avatar  string `json:"avatar"`
+		Email   string `json:"email"`
+		BizMail string `json:"biz_mail"`
+		Mobile  string `json:"mobile"`
+	}
+	err := p.doWithCorpToken(ctx, func(corpToken string) error {
+		userURL := fmt.Sprintf(
+			"%s/user/get?access_token=%s&userid=%s",
+			wecomAPIBaseURL,
+			url.QueryEscape(corpToken),
+			url.QueryEscape(userID),
+		)
+		return p.doRequest(ctx, "GET", userURL, nil, &wecomUser)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sensitive fields (avatar, email, mobile) are only returned by getuserdetail with the user_ticket
+	if userTicket, _ := token.Extra("user_ticket").(string); userTicket != "" {
+		var detail struct {
+			Avatar  string `json:"avatar"`
+			Email   string `json:"email"`
+			BizMail string `json:"biz_mail"`
+			Mobile  string `json:"mobile"`
+		}
+		err := p.doWithCorpToken(ctx, func(corpToken string) error {
+			detailURL := fmt.Sprintf("%s/auth/getuserdetail?access_token=%s", wecomAPIBaseURL, url.QueryEscape(corpToken))
+			return p.doRequest(ctx, "POST", detailURL, map[string]string{"user_ticket": userTicket}, &detail)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if detail.Avatar != "" {
+			wecomUser.Avatar = detail.Avatar
+		}
+		if detail.Email != "" {
+			wecomUser.Email = detail.Email
+		}
+		if detail.BizMail != "" {
+			wecomUser.BizMail = detail.BizMail
+		}
+		if detail.Mobile != "" {
+			wecomUser.Mobile = detail.Mobile
+		}
+	}
+
+	// Members are identified by userid, their openid is only known after a conversion
+	if p.subjectKind == types.SubjectOpenID && openID == "" {
+		var converted struct {
+			OpenID string `json:"openid"`
+		}
+		err := p.doWithCorpToken(ctx, func(corpToken string) error {
+			convertURL := fmt.Sprintf("%s/user/convert_to_openid?access_token=%s", wecomAPIBaseURL, url.QueryEscape(corpToken))
+			return p.doRequest(ctx, "POST", convertURL, map[string]string{"userid": userID}, &converted)
+		})
+		if err != nil {
+			return nil, err
+		}
+		openID = converted.OpenID
+	}
+
+	ids := compactIDs(map[string]string{
+		types.SubjectUserID: wecomUser.UserID,
+		types.SubjectOpenID: openID,
+	})
+	providerUserID, err := selectSubject("wecom", p.subjectKind, ids, types.SubjectUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	email := wecomUser.BizMail
+	if email == "" {
+		email = wecomUser.Email
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		TenantID:       p.config.ClientID,
+		Name:           wecomUser.Name,
+		AvatarURL:      wecomUser.Avatar,
+		Email:          email,
+		RawData:        wecomUser,
+	}, nil
+}
+
+// doRequest calls a WeCom API and decodes the response into out, checking the errcode envelope
+func (p *WecomProvider) doRequest(ctx context.Context, method, apiURL string, payload any, out any) error {
+	var reqBody io.Reader
+	if payload != nil {
+		jsonBody, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(jsonBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reqBody)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	if result.ErrCode != 0 {
+		return &wecomError{ErrCode: result.ErrCode, ErrMsg: result.ErrMsg}
+	}
+
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Sina Weibo's flow is close to the standard, with a few quirks.
+//
+// **Key points**:
+// * The token endpoint returns the user's `uid` alongside the `access_token`, it is stored in the token Extra.
+// * `users/show.json` requires both the `access_token` and the `uid`.
+// * Errors are reported as `{"error":"...","error_code":21325,"request":"..."}`.
+
+type WeiboProvider struct {
+	Name   string
+	config *oauth2.Config
+}
+
+func NewWeiboProvider(cfg *types.OauthConfig) types.Provider {
+	return &WeiboProvider{
+		Name: types.WEIBO,
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{}, // basic user info does not need any extra scope
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://api.weibo.com/oauth2/authorize",
+				TokenURL: "https://api.weibo.com/oauth2/access_token",
+			},
+		},
+	}
+}
+
+func (p *WeiboProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *WeiboProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	// Weibo expects the parameters as a form POST and returns the uid in the token response
+	values := url.Values{
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.config.Endpoint.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenData struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		UID         string `json:"uid"`
+		Error       string `json:"error"`
+		ErrorCode   int    `json:"error_code"`
+	}
+
+	if err := json.Unmarshal(body, &tokenData); err != nil {
+		return nil, err
+	}
+
+	if tokenData.ErrorCode != 0 || tokenData.AccessToken == "" {
+		return nil, fmt.Errorf("weibo token error: %d %s", tokenData.ErrorCode, tokenData.Error)
+	}
+
+	token := &oauth2.Token{
+		AccessToken: tokenData.AccessToken,
+		Expiry:      time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}
+	// Store uid in Extra
+	return token.WithExtra(map[string]interface{}{
+		"uid": tokenData.UID,
+	}), nil
+}
+
+func (p *WeiboProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	uid, ok := token.Extra("uid").(string)
+	if !ok || uid == "" {
+		return nil, fmt.Errorf("uid not found in token")
+	}
+
+	userInfoURL := fmt.Sprintf(
+		"https://api.weibo.com/2/users/show.json?access_token=%s&uid=%s",
+		url.QueryEscape(token.AccessToken),
+		url.QueryEscape(uid),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var weiboUser struct {
+		IDStr           string `json:"idstr"`
+		ScreenName      string `json:"screen_name"`
+		Name            string `json:"name"`
+		ProfileImageURL string `json:"profile_image_url"`
+		AvatarLarge     string `json:"avatar_large"`
+		AvatarHD        string `json:"avatar_hd"`
+		Error           string `json:"error"`
+		ErrorCode       int    `json:"error_code"`
+	}
+
+	if err := json.Unmarshal(body, &weiboUser); err != nil {
+		return nil, err
+	}
+
+	if weiboUser.ErrorCode != 0 {
+		return nil, fmt.Errorf("weibo error: %d %s", weiboUser.ErrorCode, weiboUser.Error)
+	}
+
+	providerUserID := weiboUser.IDStr
+	if providerUserID == "" {
+		providerUserID = uid
+	}
+
+	avatarURL := weiboUser.AvatarHD
+	if avatarURL == "" {
+		avatarURL = weiboUser.ProfileImageURL
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		Name:           weiboUser.ScreenName,
+		AvatarURL:      avatarURL,
+		Email:          "", // Weibo does not provide email
+		RawData:        weiboUser,
+	}, nil
+}
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: Apache-2.0
+// SPDX-FileCopyrightText: hi@xiexianbin.cn
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"go.xiexianbin.cn/authkit/types"
+)
+
+// Xiaomi account OAuth is served by account.xiaomi.com, the user APIs by open.account.xiaomi.com.
+//
+// **Key points**:
+// * The token endpoint is a GET and its JSON response is prefixed with `&&&START&&&`, which must be stripped.
+// * Scopes are numeric: `1` is the profile and `3` the openId.
+// * The user APIs take the `clientId` and `token` as query params and answer with `{result, code, description, data}`.
+// * The `mail` is not verified, it is left in RawData and not used as `UserInfo.Email`.
+
+// xiaomiResponsePrefix is prepended to the JSON responses of account.xiaomi.com
+const xiaomiResponsePrefix = "&&&START&&&"
+
+type XiaomiProvider struct {
+	Name        string
+	config      *oauth2.Config
+	subjectKind string
+}
+
+// NewXiaomiProvider creates a new Xiaomi account Provider instance, the ClientID is the app ID
+//
+// Extra fields: `SubjectID` (`openid` or `unionid`).
+func NewXiaomiProvider(cfg *types.OauthConfig) types.Provider {
+	return &XiaomiProvider{
+		Name:        types.XIAOMI,
+		subjectKind: extraString(cfg, "SubjectID"),
+		config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{"1", "3"}, // profile and openId
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://account.xiaomi.com/oauth2/authorize",
+				TokenURL: "https://account.xiaomi.com/oauth2/token",
+			},
+		},
+	}
+}
+
+func (p *XiaomiProvider) GetAuthURL(ctx context.Context, state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *XiaomiProvider) ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	query := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+	}
+
+	var tokenData struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Scope            string `json:"scope"`
+		TokenType        string `json:"token_type"`
+		MacKey           string `json:"mac_key"`
+		MacAlgorithm     string `json:"mac_algorithm"`
+		OpenID           string `json:"openId"`
+		Error            int    `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.getJSON(ctx, p.config.Endpoint.TokenURL, query, &tokenData); err != nil {
+		return nil, err
+	}
+	if tokenData.Error != 0 || tokenData.AccessToken == "" {
+		return nil, fmt.Errorf("xiaomi token error: %d %s", tokenData.Error, tokenData.ErrorDescription)
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second),
+	}
+	// Store openId/scope in Extra
+	return token.WithExtra(map[string]interface{}{
+		"openId": tokenData.OpenID,
+		"scope":  tokenData.Scope,
+	}), nil
+}
+
+func (p *XiaomiProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*types.UserInfo, error) {
+	query := url.Values{
+		"clientId": {p.config.ClientID},
+		"token":    {token.AccessToken},
+	}
+
+	var xiaomiUser struct {
+		UnionID    string `json:"unionId"`
+		MiliaoNick string `json:"miliaoNick"`
+		MiliaoIcon string `json:"miliaoIcon"`
+		Mail       string `json:"mail"`
+		Phone      string `json:"phone"`
+	}
+	if err := p.getData(ctx, "https://open.account.xiaomi.com/user/profile", query, &xiaomiUser); err != nil {
+		return nil, err
+	}
+
+	var openIDData struct {
+		OpenID  string `json:"openId"`
+		UnionID string `json:"unionId"`
+	}
+	if err := p.getData(ctx, "https://open.account.xiaomi.com/user/openidV2", query, &openIDData); err != nil {
+		return nil, err
+	}
+
+	unionID := xiaomiUser.UnionID
+	if unionID == "" {
+		unionID = openIDData.UnionID
+	}
+
+	// Prioritize using unionId, unless the subject is configured
+	ids := compactIDs(map[string]string{
+		types.SubjectOpenID:  openIDData.OpenID,
+		types.SubjectUnionID: unionID,
+	})
+	providerUserID, err := selectSubject("xiaomi", p.subjectKind, ids, types.SubjectUnionID, types.SubjectOpenID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UserInfo{
+		Provider:       p.Name,
+		ProviderUserID: providerUserID,
+		AlternateIDs:   ids,
+		Name:           xiaomiUser.MiliaoNick,
+		AvatarURL:      xiaomiUser.MiliaoIcon,
+		Phone:          xiaomiUser.Phone,
+		RawData:        xiaomiUser,
+	}, nil
+}
+
+// getData calls a Xiaomi user API and decodes the `data` of the `{result, code, description, data}` response into out
+func (p *XiaomiProvider) getData(ctx context.Context, apiURL string, query url.Values, out any) error {
+	var result struct {
+		Result      string          `json:"result"`
+		Code        int             `json:"code"`
+		Description string          `json:"description"`
+		Data        json.RawMessage `json:"data"`
+	}
+	if err := p.getJSON(ctx, apiURL, query, &result); err != nil {
+		return err
+	}
+	if result.Result != "ok" || len(result.Data) == 0 {
+		return fmt.Errorf("xiaomi error: %d %s", result.Code, result.Description)
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+// getJSON sends a GET request with the escaped query and decodes the JSON response, stripped of its `&&&START&&&` prefix
+func (p *XiaomiProvider) getJSON(ctx context.Context, apiURL string, query url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	body = bytes.TrimPrefix(bytes.TrimSpace(body), []byte(xiaomiResponsePrefix))
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("xiaomi error: unexpected response %q: %w", body, err)
+	}
+	return nil
+}
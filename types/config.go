@@ -14,6 +14,45 @@ type OauthConfig struct {
 	//
 	// - Apple-specific fields: `TeamID` `KeyID` and `AppPrivateKey`(The content of your .p8 private key file for Apple)
 	//
-	// - Alipay might require extra field: `AppPrivateKey`
+	// - Alipay-specific fields: `AppPrivateKey` (RSA2 request signing), `AlipayPublicKey` (response verification) and `Sandbox`
+	//
+	// - CAS-specific fields: `ServerURL`, `Version` (`3` or `2`), `ProxyCallbackURL` and `ProxyTicketStore` (proxy-granting tickets),
+	//   `AcceptProxyTickets`, `AllowedProxyChains`, `EmailAttribute` and `NameAttribute`
+	//
+	// - Feishu-specific fields: `Region` (`feishu` or `lark`), `AuthAPI` (`v2` or `v1`) and `Mode` (`web` or `client_code` in-app login)
+	//
+	// - DingTalk-specific fields: `Mode` (`web` or `client_code` in-app login), `CorpIDs` (allowed organizations, required in `client_code` mode with the single internal app organization) and `FetchOrgUser` (fetch the enterprise user record)
+	//
+	// - Discord-specific fields: `GuildIDs` (the user must be a member of one of these guilds)
+	//
+	// - DingTalk, Feishu and WeCom accept a `CredentialManager` (*credential.Manager) caching their app-level access tokens
+	//
+	// - Huawei and LINE accept `RequestEmail` (request the email scope, which requires a permission of the app)
+	//
+	// - LDAP-specific fields (ClientID and ClientSecret are the service account DN and password): `URL`, `StartTLS`, `Insecure` (plain ldap://), `TLSConfig`,
+	//   `BaseDN`, `UserFilter`, `NestedGroups`, `SubjectAttribute`, `EmailAttribute`, `NameAttribute` and `Timeout`
+	//
+	// - OIDC-specific fields: `Issuer` (discovery URL prefix) and `Scopes`
+	//
+	// - QQ-specific fields: `UnionID` (set to false for apps without the unionid right)
+	//
+	// - SAML-specific fields (ClientID is the SP entity ID, RedirectURL the ACS): `IDPMetadata` or `IDPMetadataURL`, `IDPEntityID`,
+	//   `MetadataURL`, `Certificate` and `PrivateKey` (SP key pair), `Binding` (`redirect` or `post`), `NameIDFormat`,
+	//   `AllowIDPInitiated`, `Store` (request IDs and replay cache), `SubjectAttribute`, `EmailAttribute` and `NameAttribute`
+	//
+	// - Slack-specific fields: `TeamIDs` (allowed workspaces)
+	//
+	// - Steam-specific fields: `APIKey` (Steam Web API key, to fetch the persona name and avatar)
+	//
+	// - Telegram-specific fields: `MaxAge` (how old the widget `auth_date` may be)
+	//
+	// - WeChat-specific fields: `Mode` (`website` QR-code login or `official_account` in-WeChat-browser) and `Scope` (`snsapi_userinfo` or `snsapi_base`)
+	//
+	// - WeCom-specific fields: `AgentID`, `Mode` (`web` QR-code login or `oauth` in-WeCom-browser), `Scope` and `MembersOnly`
+	//
+	// - Providers with several user identifiers (WeChat, QQ, DingTalk, Douyin, Feishu, Huawei, TikTok, WeCom, Xiaomi, Alipay) accept `SubjectID`
+	//   (`openid`, `unionid` or `user_id`) to pin the identifier used as `UserInfo.ProviderUserID`;
+	//   the tenant-scoped DingTalk and Feishu `user_id` is qualified as `<tenant>:<user_id>`,
+	//   Microsoft accepts `user_id` (Graph `id`) or `oid` (`<oid>:<tid>` from the id_token)
 	Extra map[string]any
 }
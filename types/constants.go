@@ -4,15 +4,34 @@
 package types
 
 const (
-	ALIPAY    = "alipay"
-	APPLE     = "apple"
-	DINGTALK  = "dingtalk"
-	FACEBOOK  = "facebook"
-	FEISHU    = "feishu"
-	GITHUB    = "github"
-	GOOGLE    = "google"
-	MICROSOFT = "microsoft"
-	QQ        = "qq"
-	TWITTER   = "twitter"
-	WECHAT    = "wechat"
+	ALIPAY             = "alipay"
+	APPLE              = "apple"
+	CAS                = "cas"
+	DINGTALK           = "dingtalk"
+	DISCORD            = "discord"
+	DOUYIN             = "douyin"
+	FACEBOOK           = "facebook"
+	FEISHU             = "feishu"
+	GITHUB             = "github"
+	GOOGLE             = "google"
+	HUAWEI             = "huawei"
+	KAKAO              = "kakao"
+	LDAP               = "ldap"
+	LINE               = "line"
+	LINKEDIN           = "linkedin"
+	MICROSOFT          = "microsoft"
+	NAVER              = "naver"
+	OIDC               = "oidc"
+	QQ                 = "qq"
+	SAML               = "saml"
+	SLACK              = "slack"
+	STEAM              = "steam"
+	TELEGRAM           = "telegram"
+	TIKTOK             = "tiktok"
+	TWITTER            = "twitter"
+	WECHAT             = "wechat"
+	WECHAT_MINIPROGRAM = "wechat_miniprogram"
+	WECOM              = "wecom"
+	WEIBO              = "weibo"
+	XIAOMI             = "xiaomi"
 )
@@ -5,19 +5,41 @@ package types
 
 import (
 	"context"
+	"errors"
+	"net/url"
 
 	"golang.org/x/oauth2"
 )
 
+// Subject identifier kinds returned by providers with several user identifiers,
+// used as keys of UserInfo.AlternateIDs and as values of the `Extra["SubjectID"]` config
+const (
+	// SubjectOpenID is unique per user and app (WeChat/QQ openid, Feishu open_id, Alipay open_id, ...)
+	SubjectOpenID = "openid"
+	// SubjectUnionID is unique per user across the apps of one developer account (WeChat/QQ unionid, Feishu union_id, ...)
+	SubjectUnionID = "unionid"
+	// SubjectUserID is unique per user within a tenant or the whole platform (Feishu/WeCom userid, Alipay user_id, ...)
+	SubjectUserID = "user_id"
+)
+
 // UserInfo defines a standardized structure of user information
 // obtained from any OAuth Provider
 type UserInfo struct {
-	Provider       string
+	Provider string
+	// ProviderUserID is the primary subject, stable as long as the provider subject config does not change
 	ProviderUserID string
-	Email          string
-	Name           string
-	AvatarURL      string
-	RawData        any
+	// AlternateIDs holds every identifier returned by the provider, keyed by kind (e.g. SubjectOpenID),
+	// so that accounts linked with another kind can be matched and migrated
+	AlternateIDs map[string]string
+	// TenantID is the organization the user signed in with, if any (DingTalk corpId, WeCom corpid, Feishu tenant_key)
+	TenantID  string
+	Email     string
+	Name      string
+	AvatarURL string
+	Phone     string
+	// Groups the user is a member of, for directory providers (LDAP group DNs)
+	Groups  []string
+	RawData any
 }
 
 // Provider is a mandatory interface for all OAuth implementations
@@ -26,3 +48,26 @@ type Provider interface {
 	ExchangeCodeForToken(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
 	GetUserInfo(ctx context.Context, token *oauth2.Token) (*UserInfo, error)
 }
+
+// CredentialVerifier is implemented by redirect-less logins (e.g. Telegram Login Widget),
+// where the client submits signed credentials which are verified directly instead of exchanging a code
+type CredentialVerifier interface {
+	VerifyCredentials(ctx context.Context, credentials url.Values) (*UserInfo, error)
+}
+
+// DeviceAuthProvider is optionally implemented by providers supporting the OAuth 2.0 Device Authorization Grant (RFC 8628),
+// for CLI and TV apps which can not receive a browser redirect
+type DeviceAuthProvider interface {
+	// DeviceAuth starts a device login, the user opens the VerificationURI and enters the UserCode
+	DeviceAuth(ctx context.Context, opts ...oauth2.AuthCodeOption) (*oauth2.DeviceAuthResponse, error)
+	// DeviceAccessToken polls the provider at the returned interval (slowed down when asked) until the user
+	// authorized the device, the token is then used with GetUserInfo as the one of ExchangeCodeForToken
+	DeviceAccessToken(ctx context.Context, da *oauth2.DeviceAuthResponse, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+}
+
+var (
+	// ErrDeviceCodeExpired is returned by DeviceAccessToken when the user did not authorize the device in time
+	ErrDeviceCodeExpired = errors.New("device code expired")
+	// ErrDeviceAccessDenied is returned by DeviceAccessToken when the user denied the authorization
+	ErrDeviceAccessDenied = errors.New("device authorization denied")
+)